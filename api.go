@@ -1,27 +1,77 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/imroc/req"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
-	"regexp"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
 	"time"
 	"v2ray.com/core/common/uuid"
 )
 
+// 小冰读心术会话, 每个会话持有独立的CookieJar
+// (cpid, salt, ARRAffinity, cookieid, ai_session_id, ai_user)
 type Bing struct {
-	client   *req.Req
-	senderID string
+	client    *req.Req
+	opts      BingOptions
+	senderID  string
+	questions int         // 本局最近一个问题的序号
+	history   []BingRound // 本局问答记录
 }
 
+// 小冰接口调用选项, 零值字段使用默认值
+type BingOptions struct {
+	Timeout time.Duration // 单次请求超时, 默认3秒
+	Retries int           // 失败时的重试次数, 默认2次, 小于0时不重试; 回答(POST)仅在连接失败时重试
+	Backoff time.Duration // 首次重试前的等待时间, 之后每次加倍, 默认200毫秒
+	HTTP    HTTPOptions   // BaseURL默认为http://webapps.msxiaobing.com
+}
+
+// 一轮问答
+type BingRound struct {
+	Send  string `json:"send"`
+	Reply string `json:"reply"`
+}
+
+// 可序列化的会话状态, 用于持久化和在其他进程中恢复会话
+type BingState struct {
+	SenderID  string         `json:"sender_id"`
+	Cookies   []*http.Cookie `json:"cookies"`
+	Questions int            `json:"questions"`
+	History   []BingRound    `json:"history"`
+}
+
+// 小冰接口错误, Msg可直接回复给用户
+type BingError struct {
+	Code int
+	Msg  string
+}
+
+func (e BingError) Error() string {
+	return e.Msg
+}
+
+var (
+	ErrBingDown        = BingError{Code: 1, Msg: "小冰失联了……"}
+	ErrBingExpired     = BingError{Code: 2, Msg: "游戏已过期，请重新开始"}
+	ErrBingRateLimited = BingError{Code: 3, Msg: "小冰太忙了，请稍后再试"}
+	ErrBingNoAnswer    = BingError{Code: 4, Msg: "小冰不知怎么回答"}
+)
+
 // 接口
 const (
-	baseURL  = "http://webapps.msxiaobing.com"
-	entryURL = baseURL + "/mindreader"
-	respURL  = baseURL + "/simplechat/getresponse?workflow=Q20"
-	authURL  = baseURL + "/api/wechatAuthorize/signature?url=" + entryURL
+	baseURL   = "http://webapps.msxiaobing.com"
+	entryPath = "/mindreader"
+	respPath  = "/simplechat/getresponse?workflow=Q20"
+	authPath  = "/api/wechatAuthorize/signature?url="
 )
 
 // 回答
@@ -33,16 +83,13 @@ const (
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
-var answerRe = regexp.MustCompile(`"Text":"([^"]+)"`)
-var headers = req.Header{
+var defaultHeaders = req.Header{
 	"Accept-Encoding":  "",
 	"Accept-Language":  "zh-CN,zh;q=0.9,en;q=0.8,zh-TW;q=0.7",
 	"User-Agent":       "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_1)",
 	"Content-Type":     "application/json",
 	"X-Requested-With": "XMLHttpRequest",
-	"Referer":          entryURL,
 }
-var cookieSession, cookieUser *http.Cookie
 
 // 生成随机字符串
 func randString(n int) string {
@@ -53,71 +100,239 @@ func randString(n int) string {
 	return string(b)
 }
 
-// 新建会话
-func NewBing() (Bing, error) {
-	// 请求首页，获取Cookie:cpid,salt,ARRAffinity
+// 填充默认选项
+func (o BingOptions) withDefaults() BingOptions {
+	if o.Timeout <= 0 {
+		o.Timeout = 3 * time.Second
+	}
+	if o.Retries == 0 {
+		o.Retries = 2
+	} else if o.Retries < 0 {
+		o.Retries = 0
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = 200 * time.Millisecond
+	}
+	return o
+}
+
+func (o BingOptions) baseURL() string {
+	return strings.TrimRight(o.HTTP.baseURL(baseURL), "/")
+}
+
+func (o BingOptions) entryURL() string {
+	return o.baseURL() + entryPath
+}
+
+func (o BingOptions) respURL() string {
+	return o.baseURL() + respPath
+}
+
+func (o BingOptions) authURL() string {
+	return o.baseURL() + authPath + o.entryURL()
+}
+
+// 请求头, Referer为首页
+func (o BingOptions) headers() req.Header {
+	h := req.Header{"Referer": o.entryURL()}
+	for k, v := range defaultHeaders {
+		h[k] = v
+	}
+	return h
+}
+
+// 构造使用jar的请求客户端, 每个会话持有独立的CookieJar
+// 单次请求超时由do通过context控制
+func (o BingOptions) newClient(jar http.CookieJar) (*req.Req, error) {
+	httpClient, err := o.HTTP.newHTTPClient(0)
+	if err != nil {
+		return nil, err
+	}
+	httpClient.Jar = jar
 	client := req.New()
-	r, _ := client.Get(entryURL)
+	client.SetClient(httpClient)
+	return client, nil
+}
+
+// 发送请求并返回响应体, 失败时按指数退避重试
+// 回复页的POST不是幂等的, 小冰处理了回答但响应超时时重发会跳过一题,
+// 因此POST仅在连接失败(请求未发出)时重试, GET在网络错误和5xx响应时均重试
+func (o BingOptions) do(ctx context.Context, client *req.Req, method string, url string, v ...interface{}) ([]byte, error) {
+	backoff := o.Backoff
+	for attempt := 0; ; attempt++ {
+		body, sent, err := o.doOnce(ctx, client, method, url, v...)
+		retry := err == ErrBingDown && (method == http.MethodGet || !sent)
+		if !retry || attempt >= o.Retries {
+			return body, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ErrBingDown
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// 发送一次请求, sent表示请求是否可能已到达小冰
+func (o BingOptions) doOnce(ctx context.Context, client *req.Req, method string, url string, v ...interface{}) (body []byte, sent bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, o.Timeout)
+	defer cancel()
+	r, err := client.Do(method, url, append(v, ctx)...)
+	if err != nil {
+		log.Printf("请求小冰接口失败: %s %s: %s\n", method, url, err)
+		return nil, !isDialError(err), ErrBingDown
+	}
 	resp := r.Response()
-	if resp.StatusCode != 200 {
-		return Bing{}, fmt.Errorf("请求首页失败")
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, true, ErrBingRateLimited
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, true, ErrBingExpired
+	case resp.StatusCode != http.StatusOK:
+		log.Printf("小冰接口返回错误: %s %s: %d\n", method, url, resp.StatusCode)
+		return nil, true, ErrBingDown
+	}
+	body, err = r.ToBytes()
+	if err != nil {
+		return nil, true, ErrBingDown
+	}
+	return body, true, nil
+}
+
+// 是否为建立连接时的错误, 此时请求尚未发出
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
+
+// 新建会话
+func NewBing(ctx context.Context, opts BingOptions) (Bing, error) {
+	opts = opts.withDefaults()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return Bing{}, err
+	}
+	client, err := opts.newClient(jar)
+	if err != nil {
+		return Bing{}, err
+	}
+	// 请求首页，获取Cookie:cpid,salt,ARRAffinity
+	if _, err := opts.do(ctx, client, http.MethodGet, opts.entryURL()); err != nil {
+		return Bing{}, err
 	}
 	// 随机生成Cookie:ai_session_id,ai_user
 	now := fmt.Sprintf("%.1f", float64(time.Now().UnixNano()/1e6))
 	aiSession := fmt.Sprintf("%s|%s|%s", randString(5), now, now)
-	aiUser := fmt.Sprintf("%s|%s", randString(5), fmt.Sprintf(time.Now().UTC().Format("2006-01-02T15:04:05.999Z")))
-	cookieSession = &http.Cookie{Name: "ai_session_id", Value: aiSession}
-	cookieUser = &http.Cookie{Name: "ai_user", Value: aiUser}
+	aiUser := fmt.Sprintf("%s|%s", randString(5), time.Now().UTC().Format("2006-01-02T15:04:05.999Z"))
+	// 写入本会话独立的CookieJar, 与其他会话隔离
+	u, _ := url.Parse(opts.baseURL())
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "ai_session_id", Value: aiSession, Path: "/"},
+		{Name: "ai_user", Value: aiUser, Path: "/"},
+	})
 
 	// 请求签名页面
-	r, _ = client.Get(authURL, headers)
-	resp = r.Response()
-	if resp.StatusCode != 200 {
-		return Bing{}, fmt.Errorf("请求签名页失败")
+	if _, err := opts.do(ctx, client, http.MethodGet, opts.authURL(), opts.headers()); err != nil {
+		return Bing{}, err
 	}
 
 	// 请求回复页，获取Cookie:cookieid
 	_senderID := uuid.New()
 	senderID := _senderID.String()
-	body := fmt.Sprintf(`{"SenderId":"%s","Content":{"Text":"玩","Image":"","Metadata":{"Q20H5Enter":"true"}}}`, senderID)
-	r, _ = client.Post(respURL, headers, body, cookieUser, cookieSession)
-	resp = r.Response()
-	if resp.StatusCode != 200 {
-		return Bing{}, fmt.Errorf("新建游戏失败")
+	body, err := json.Marshal(BingRequest{
+		SenderID: senderID,
+		Content: BingContent{
+			Text:     "玩",
+			Metadata: map[string]string{"Q20H5Enter": "true"},
+		},
+	})
+	if err != nil {
+		return Bing{}, err
+	}
+	if _, err := opts.do(ctx, client, http.MethodPost, opts.respURL(), opts.headers(), body); err != nil {
+		return Bing{}, err
 	}
 
 	return Bing{
 		client:   client,
+		opts:     opts,
 		senderID: senderID,
 	}, nil
 }
 
+// 导出会话状态
+func (b Bing) State() BingState {
+	state := BingState{
+		SenderID:  b.senderID,
+		Questions: b.questions,
+		History:   append([]BingRound(nil), b.history...),
+	}
+	if jar := b.client.Client().Jar; jar != nil {
+		u, _ := url.Parse(b.opts.baseURL())
+		state.Cookies = jar.Cookies(u)
+	}
+	return state
+}
+
+// 从会话状态恢复会话
+func RestoreBing(state BingState, opts BingOptions) (Bing, error) {
+	if state.SenderID == "" {
+		return Bing{}, fmt.Errorf("会话状态缺少SenderId")
+	}
+	opts = opts.withDefaults()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return Bing{}, err
+	}
+	u, _ := url.Parse(opts.baseURL())
+	jar.SetCookies(u, state.Cookies)
+	client, err := opts.newClient(jar)
+	if err != nil {
+		return Bing{}, err
+	}
+	return Bing{
+		client:    client,
+		opts:      opts,
+		senderID:  state.SenderID,
+		questions: state.Questions,
+		history:   state.History,
+	}, nil
+}
+
 // 与小冰聊天
-func (b Bing) send(a string) string {
-	body := fmt.Sprintf(`{"SenderId":"%s","Content":{"Text":"%s","Image":""}}`, b.senderID, a)
-	r, _ := b.client.Post(respURL, body, headers, cookieUser, cookieSession)
-	html, err := r.ToString()
-	resp := r.Response()
-	if err != nil || resp.StatusCode != 200 {
-		return "小冰失联了……"
-	}
-	items := answerRe.FindAllStringSubmatch(html, -1)
-	// 从响应包中取出回复文本
-	if len(items) > 0 {
-		var q, gap string
-		for _, v := range items {
-			q += gap + v[1]
-			gap = " "
-		}
-		log.Println("A:", a, "Q:", q)
-		return q
-	} else {
-		return "小冰不知怎么回答"
+func (b *Bing) Send(ctx context.Context, a string) (GameTurn, error) {
+	body, err := json.Marshal(BingRequest{
+		SenderID: b.senderID,
+		Content:  BingContent{Text: a},
+	})
+	if err != nil {
+		return GameTurn{}, err
+	}
+	raw, err := b.opts.do(ctx, b.client, http.MethodPost, b.opts.respURL(), b.opts.headers(), body)
+	if err != nil {
+		return GameTurn{}, err
+	}
+	// 开始新游戏时重置问题序号
+	if a == "开始" {
+		b.questions = 0
+		b.history = nil
+	}
+	turn, err := parseTurn(raw, b.questions)
+	if err != nil {
+		return turn, err
+	}
+	log.Println("A:", a, "Q:", turn.Text)
+	if turn.Index > 0 {
+		b.questions = turn.Index
 	}
+	// 会话可能被复制后保存在SessionStore中, 追加时复制底层数组, 不修改其他副本的记录
+	b.history = append(b.history[:len(b.history):len(b.history)], BingRound{Send: a, Reply: turn.Text})
+	return turn, nil
 }
 
 // 回答游戏选项
-func (b Bing) Next(answer int) string {
+func (b *Bing) Next(ctx context.Context, answer int) (GameTurn, error) {
 	var s string
 	switch answer {
 	case Yes:
@@ -127,5 +342,5 @@ func (b Bing) Next(answer int) string {
 	case Pass:
 		s = "不知道"
 	}
-	return b.send(s)
+	return b.Send(ctx, s)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/speng4096/bing/bingtest"
+)
+
+func newTestBing(t *testing.T, questions int) (Bing, *bingtest.Server) {
+	t.Helper()
+	srv := bingtest.NewServer(bingtest.Linear(questions, "周杰伦"))
+	t.Cleanup(srv.Close)
+	bing, err := NewBing(context.Background(), testBingOptions(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bing, srv
+}
+
+func testBingOptions(srv *bingtest.Server) BingOptions {
+	return BingOptions{Backoff: time.Millisecond, HTTP: HTTPOptions{BaseURL: srv.URL}}
+}
+
+// 完整的15题游戏
+func TestBingGame(t *testing.T) {
+	ctx := context.Background()
+	bing, _ := newTestBing(t, 15)
+	turn, err := bing.Send(ctx, "开始")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if turn.Index != 1 || turn.End {
+		t.Fatalf("开始后应为第1题: %+v", turn)
+	}
+	for i := 2; i <= 16; i++ {
+		turn, err = bing.Next(ctx, Yes)
+		if err != nil {
+			t.Fatalf("第%d轮: %s", i, err)
+		}
+		if i <= 15 && (turn.Index != i || turn.Question == "" || turn.End) {
+			t.Fatalf("应为第%d题: %+v", i, turn)
+		}
+	}
+	if turn.Guess != "周杰伦" || turn.GuessImage == "" || !turn.End {
+		t.Fatalf("15题后应猜出周杰伦并结束: %+v", turn)
+	}
+	if n := len(bing.State().History); n != 16 {
+		t.Fatalf("问答记录为%d轮, 应为16轮", n)
+	}
+
+	// 重新开始
+	if turn, err = bing.Send(ctx, "开始"); err != nil || turn.Index != 1 {
+		t.Fatalf("重新开始后应为第1题: %+v, %v", turn, err)
+	}
+	if n := len(bing.State().History); n != 1 {
+		t.Fatalf("重新开始后问答记录为%d轮, 应为1轮", n)
+	}
+}
+
+// 从会话状态恢复后继续游戏
+func TestBingRestore(t *testing.T) {
+	ctx := context.Background()
+	bing, srv := newTestBing(t, 5)
+	bing.Send(ctx, "开始")
+	bing.Next(ctx, No)
+
+	restored, err := RestoreBing(bing.State(), testBingOptions(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	turn, err := restored.Next(ctx, Pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if turn.Index != 3 {
+		t.Fatalf("恢复后应为第3题: %+v", turn)
+	}
+}
+
+func TestBingErrors(t *testing.T) {
+	ctx := context.Background()
+
+	// 首页的GET在5xx时重试
+	srv := bingtest.NewServer(bingtest.Linear(3, "周杰伦"))
+	defer srv.Close()
+	srv.Fail(2, http.StatusBadGateway)
+	bing, err := NewBing(ctx, testBingOptions(srv))
+	if err != nil {
+		t.Fatalf("重试后应成功: %s", err)
+	}
+	srv.Fail(3, http.StatusInternalServerError)
+	if _, err := NewBing(ctx, testBingOptions(srv)); err != ErrBingDown {
+		t.Fatalf("重试次数用尽后返回%v, 应为ErrBingDown", err)
+	}
+
+	if _, err := bing.Send(ctx, "开始"); err != nil {
+		t.Fatal(err)
+	}
+	// 回答不是幂等的, 小冰返回5xx时不重试
+	calls := len(srv.Calls())
+	srv.Fail(1, http.StatusInternalServerError)
+	if _, err := bing.Next(ctx, Yes); err != ErrBingDown {
+		t.Fatalf("返回%v, 应为ErrBingDown", err)
+	}
+	if n := len(srv.Calls()) - calls; n != 1 {
+		t.Fatalf("回答请求了%d次, 应为1次", n)
+	}
+
+	srv.Fail(1, http.StatusTooManyRequests)
+	if _, err := bing.Next(ctx, Yes); err != ErrBingRateLimited {
+		t.Fatalf("返回%v, 应为ErrBingRateLimited", err)
+	}
+
+	srv.ExpireSessions()
+	if _, err := bing.Next(ctx, Yes); err != ErrBingExpired {
+		t.Fatalf("返回%v, 应为ErrBingExpired", err)
+	}
+}
+
+// 单次请求超时
+func TestBingTimeout(t *testing.T) {
+	srv := bingtest.NewServer(bingtest.Linear(3, "周杰伦"))
+	defer srv.Close()
+	srv.Latency = 200 * time.Millisecond
+	opts := testBingOptions(srv)
+	opts.Timeout = 20 * time.Millisecond
+	opts.Retries = -1
+	if _, err := NewBing(context.Background(), opts); err != ErrBingDown {
+		t.Fatalf("返回%v, 应为ErrBingDown", err)
+	}
+}
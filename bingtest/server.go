@@ -0,0 +1,234 @@
+// bingtest提供基于httptest的小冰读心术模拟服务, 用于离线测试Bing和完整的游戏流程
+//
+//	srv := bingtest.NewServer(bingtest.Linear(15, "周杰伦"))
+//	defer srv.Close()
+//	bing, err := NewBing(ctx, BingOptions{HTTP: HTTPOptions{BaseURL: srv.URL}})
+package bingtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// 问题树节点, Guess不为空时为叶子节点
+type Node struct {
+	Question   string
+	Yes        *Node
+	No         *Node
+	Pass       *Node // 为nil时按No处理
+	Guess      string
+	GuessImage string
+}
+
+// 生成n个问题后猜测guess的线性问题树, 无论如何回答都进入下一题
+func Linear(n int, guess string) *Node {
+	leaf := &Node{Guess: guess, GuessImage: "http://example.com/" + guess + ".jpg"}
+	node := leaf
+	for i := n; i >= 1; i-- {
+		node = &Node{Question: fmt.Sprintf("第%d题：这个人的第%d个特征符合吗？", i, i), Yes: node, No: node}
+	}
+	return node
+}
+
+// 一次请求记录
+type Call struct {
+	Method   string
+	Path     string
+	SenderID string
+	Text     string
+	Time     time.Time
+}
+
+// 模拟的小冰读心术服务
+type Server struct {
+	*httptest.Server
+	Root    *Node
+	Latency time.Duration // 每次请求的延迟
+
+	mu       sync.Mutex
+	games    map[string]*game // SenderId -> 游戏状态
+	failures []int            // 待返回的HTTP状态码
+	calls    []Call
+}
+
+type game struct {
+	node *Node
+}
+
+// 启动模拟服务, root为问题树的根节点, 使用完毕后需调用Close
+func NewServer(root *Node) *Server {
+	s := &Server{Root: root, games: map[string]*game{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// 使接下来的n次请求返回HTTP状态码status, 如500, 429, 401
+func (s *Server) Fail(n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, status)
+	}
+}
+
+// 清除所有游戏状态, 之后的请求返回401
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.games = map[string]*game{}
+}
+
+// 全部请求记录
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// 请求体和响应中的消息
+type message struct {
+	SenderID string  `json:"SenderId,omitempty"`
+	Content  content `json:"Content"`
+}
+
+type content struct {
+	Text             string            `json:"Text"`
+	Image            string            `json:"Image"`
+	SuggestedReplies []string          `json:"SuggestedReplies,omitempty"`
+	Metadata         map[string]string `json:"Metadata,omitempty"`
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Latency > 0 {
+		select {
+		case <-time.After(s.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	req := message{}
+	json.Unmarshal(body, &req)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, Call{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		SenderID: req.SenderID,
+		Text:     req.Content.Text,
+		Time:     time.Now(),
+	})
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/mindreader":
+		for _, name := range []string{"cpid", "salt", "ARRAffinity"} {
+			http.SetCookie(w, &http.Cookie{Name: name, Value: name + "-value", Path: "/"})
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>mindreader</body></html>"))
+	case "/api/wechatAuthorize/signature":
+		if !hasCookies(r, "cpid", "ai_session_id", "ai_user") {
+			http.Error(w, "missing cookie", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"appId": "fake", "timestamp": time.Now().Unix(), "signature": "fake"})
+	case "/simplechat/getresponse":
+		if r.URL.Query().Get("workflow") != "Q20" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		if !hasCookies(r, "cpid", "ai_session_id", "ai_user") || req.SenderID == "" {
+			http.Error(w, "missing cookie", http.StatusUnauthorized)
+			return
+		}
+		s.respond(w, req)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// 推进游戏并返回小冰的回复, 需持有锁
+func (s *Server) respond(w http.ResponseWriter, req message) {
+	if req.Content.Metadata["Q20H5Enter"] == "true" {
+		s.games[req.SenderID] = &game{}
+		http.SetCookie(w, &http.Cookie{Name: "cookieid", Value: req.SenderID, Path: "/"})
+		writeMessages(w, content{Text: "想好一个人了吗？准备好了就说开始吧"})
+		return
+	}
+	g, ok := s.games[req.SenderID]
+	if !ok {
+		http.Error(w, "session expired", http.StatusUnauthorized)
+		return
+	}
+	if req.Content.Text == "开始" {
+		g.node = s.Root
+	} else if g.node == nil || g.node.Guess != "" {
+		writeMessages(w, content{Text: "游戏结束了，说开始可以再来一局"})
+		return
+	} else {
+		var next *Node
+		switch req.Content.Text {
+		case "是":
+			next = g.node.Yes
+		case "不是":
+			next = g.node.No
+		case "不知道":
+			next = g.node.Pass
+			if next == nil {
+				next = g.node.No
+			}
+		default:
+			writeMessages(w, content{Text: "请回答是、不是或不知道哦"})
+			return
+		}
+		if next == nil {
+			writeMessages(w, content{Text: "我猜不出来了，游戏结束"})
+			g.node = nil
+			return
+		}
+		g.node = next
+	}
+	if g.node.Guess != "" {
+		writeMessages(w,
+			content{Text: "我猜你想的是：" + g.node.Guess, Image: g.node.GuessImage},
+			content{Text: "猜对了吗？再来一局吧", SuggestedReplies: []string{"开始"}},
+		)
+		return
+	}
+	writeMessages(w, content{Text: g.node.Question, SuggestedReplies: []string{"是", "不是", "不知道"}})
+}
+
+func hasCookies(r *http.Request, names ...string) bool {
+	for _, name := range names {
+		if c, err := r.Cookie(name); err != nil || c.Value == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func writeMessages(w http.ResponseWriter, contents ...content) {
+	messages := make([]message, len(contents))
+	for i, c := range contents {
+		messages[i] = message{Content: c}
+	}
+	writeJSON(w, messages)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
@@ -2,38 +2,68 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
+// 缓存, 多个公众号或多个副本共享缓存时, key由Client加上AppID前缀
 type Cache interface {
-	Get() (string, error)            // 取出accessToken, 当error!=时, accessToken为空或已过期
-	Set(value string, ttl int) error // 设置新的accessToken和对应的有效时间(ttl)
+	Get(key string) (string, error)              // 取出key对应的值, 当error!=nil时, 值为空或已过期
+	Set(key string, value string, ttl int) error // 设置key对应的值和有效时间(ttl, 秒)
+	Delete(key string) error                     // 清除key对应的值, 用于值提前失效时
 }
 
+// 缓存的key
+const (
+	CacheKeyAccessToken = "access_token"
+	CacheKeyJSAPITicket = "jsapi_ticket"
+	CacheKeyCardTicket  = "wx_card_ticket"
+)
+
+// 进程内缓存
 type SimpleCache struct {
-	Value  string
-	Expire int64
+	mu      sync.RWMutex
+	entries map[string]cacheEntry
 }
 
-var defaultCache *SimpleCache
+type cacheEntry struct {
+	Value  string `json:"value"`
+	Expire int64  `json:"expire"`
+}
+
+var (
+	defaultCache     *SimpleCache
+	defaultCacheOnce sync.Once
+)
 
 func NewSimpleCache() *SimpleCache {
-	if defaultCache == nil {
-		defaultCache = &SimpleCache{}
-	}
+	defaultCacheOnce.Do(func() {
+		defaultCache = &SimpleCache{entries: map[string]cacheEntry{}}
+	})
 	return defaultCache
 }
 
-func (d SimpleCache) Get() (string, error) {
-	if d.Expire < time.Now().Unix() {
+func (d *SimpleCache) Get(key string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	entry, ok := d.entries[key]
+	if !ok || entry.Expire < time.Now().Unix() {
 		return "", fmt.Errorf("value已过期")
 	} else {
-		return d.Value, nil
+		return entry.Value, nil
 	}
 }
 
-func (d *SimpleCache) Set(value string, ttl int) error {
-	d.Value = value
-	d.Expire = time.Now().Unix() + int64(ttl)
+func (d *SimpleCache) Set(key string, value string, ttl int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[key] = cacheEntry{Value: value, Expire: time.Now().Unix() + int64(ttl)}
+	return nil
+}
+
+func (d *SimpleCache) Delete(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.entries, key)
 	return nil
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// 文件缓存, 读写时对文件加锁, 同一台机器上的多个进程可共享
+type FileCache struct {
+	path string
+}
+
+func NewFileCache(path string) *FileCache {
+	return &FileCache{path: path}
+}
+
+func (f *FileCache) Get(key string) (string, error) {
+	var value string
+	err := f.update(false, func(entries map[string]cacheEntry) bool {
+		entry, ok := entries[key]
+		if !ok || entry.Expire < time.Now().Unix() {
+			return false
+		}
+		value = entry.Value
+		return false
+	})
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", fmt.Errorf("value已过期")
+	}
+	return value, nil
+}
+
+func (f *FileCache) Set(key string, value string, ttl int) error {
+	return f.update(true, func(entries map[string]cacheEntry) bool {
+		entries[key] = cacheEntry{Value: value, Expire: time.Now().Unix() + int64(ttl)}
+		return true
+	})
+}
+
+func (f *FileCache) Delete(key string) error {
+	return f.update(true, func(entries map[string]cacheEntry) bool {
+		if _, ok := entries[key]; !ok {
+			return false
+		}
+		delete(entries, key)
+		return true
+	})
+}
+
+// 加锁读取缓存文件, fn返回true时写回文件, exclusive为false时加共享锁
+func (f *FileCache) update(exclusive bool, fn func(entries map[string]cacheEntry) bool) error {
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("打开缓存文件失败: %s", err)
+	}
+	defer file.Close()
+	if err := lockFile(file, exclusive); err != nil {
+		return fmt.Errorf("缓存文件加锁失败: %s", err)
+	}
+	defer unlockFile(file)
+
+	entries := map[string]cacheEntry{}
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("读取缓存文件失败: %s", err)
+	}
+	// 文件为空或已损坏时视为无缓存
+	if len(b) > 0 {
+		json.Unmarshal(b, &entries)
+	}
+	if !fn(entries) || !exclusive {
+		return nil
+	}
+	// 写回时顺便清理过期的值
+	now := time.Now().Unix()
+	for k, entry := range entries {
+		if entry.Expire < now {
+			delete(entries, k)
+		}
+	}
+	b, err = json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("写入缓存文件失败: %s", err)
+	}
+	if _, err := file.WriteAt(b, 0); err != nil {
+		return fmt.Errorf("写入缓存文件失败: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// 兼容Redis语义的键值存储, 可用go-redis等客户端包装实现, 用于多副本共享缓存
+type KVStore interface {
+	Get(key string) (string, error)                          // key不存在时返回ErrKeyNotFound
+	SetEX(key string, value string, ttl time.Duration) error // 设置值和过期时间
+	Del(key string) error                                    // 删除key, key不存在时不返回错误
+}
+
+var ErrKeyNotFound = fmt.Errorf("key不存在")
+
+// 将KVStore适配为Cache, 过期由KVStore负责
+type KVCache struct {
+	store  KVStore
+	prefix string
+}
+
+// prefix用于区分同一存储中的不同应用, 如"bing:"
+func NewKVCache(store KVStore, prefix string) *KVCache {
+	return &KVCache{store: store, prefix: prefix}
+}
+
+func (k *KVCache) Get(key string) (string, error) {
+	value, err := k.store.Get(k.prefix + key)
+	if err != nil {
+		return "", err
+	}
+	if value == "" {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (k *KVCache) Set(key string, value string, ttl int) error {
+	return k.store.SetEX(k.prefix+key, value, time.Duration(ttl)*time.Second)
+}
+
+func (k *KVCache) Delete(key string) error {
+	return k.store.Del(k.prefix + key)
+}
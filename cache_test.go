@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 进程内的KVStore, 模拟Redis的GET/SETEX/DEL语义, 时间可手动推进
+type fakeKVStore struct {
+	mu     sync.Mutex
+	now    time.Time
+	values map[string]fakeKVEntry
+}
+
+type fakeKVEntry struct {
+	value  string
+	expire time.Time
+}
+
+func newFakeKVStore() *fakeKVStore {
+	return &fakeKVStore{now: time.Now(), values: map[string]fakeKVEntry{}}
+}
+
+func (s *fakeKVStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.values[key]
+	if !ok || !entry.expire.After(s.now) {
+		delete(s.values, key)
+		return "", ErrKeyNotFound
+	}
+	return entry.value, nil
+}
+
+func (s *fakeKVStore) SetEX(key string, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = fakeKVEntry{value: value, expire: s.now.Add(ttl)}
+	return nil
+}
+
+func (s *fakeKVStore) Del(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *fakeKVStore) advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+// 各Cache实现共同的行为
+func testCache(t *testing.T, c Cache) {
+	t.Helper()
+	if _, err := c.Get("wx1:access_token"); err == nil {
+		t.Fatal("未设置的key应返回错误")
+	}
+	if err := c.Set("wx1:access_token", "token1", 7200); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("wx2:access_token", "token2", 7200); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"wx1:access_token": "token1", "wx2:access_token": "token2"} {
+		if got, err := c.Get(key); err != nil || got != want {
+			t.Fatalf("Get(%q)为%q, %v, 应为%q", key, got, err, want)
+		}
+	}
+	// 覆盖
+	c.Set("wx1:access_token", "token3", 7200)
+	if got, _ := c.Get("wx1:access_token"); got != "token3" {
+		t.Fatalf("覆盖后Get为%q, 应为token3", got)
+	}
+	// 删除不影响其他key
+	if err := c.Delete("wx1:access_token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("wx1:access_token"); err == nil {
+		t.Fatal("删除后Get应返回错误")
+	}
+	if got, _ := c.Get("wx2:access_token"); got != "token2" {
+		t.Fatalf("删除其他key后Get为%q, 应为token2", got)
+	}
+	if err := c.Delete("wx1:access_token"); err != nil {
+		t.Fatalf("删除不存在的key返回错误: %s", err)
+	}
+	// 过期
+	c.Set("wx1:jsapi_ticket", "ticket", -1)
+	if _, err := c.Get("wx1:jsapi_ticket"); err == nil {
+		t.Fatal("过期的key应返回错误")
+	}
+}
+
+func TestSimpleCache(t *testing.T) {
+	testCache(t, &SimpleCache{entries: map[string]cacheEntry{}})
+}
+
+func TestFileCache(t *testing.T) {
+	testCache(t, NewFileCache(filepath.Join(t.TempDir(), "cache.json")))
+}
+
+func TestKVCache(t *testing.T) {
+	testCache(t, NewKVCache(newFakeKVStore(), "bing:"))
+}
+
+func TestKVCacheExpire(t *testing.T) {
+	store := newFakeKVStore()
+	c := NewKVCache(store, "bing:")
+	c.Set("wx1:access_token", "token", 7200)
+	store.advance(7199 * time.Second)
+	if got, err := c.Get("wx1:access_token"); err != nil || got != "token" {
+		t.Fatalf("未过期时Get为%q, %v", got, err)
+	}
+	store.advance(time.Second)
+	if _, err := c.Get("wx1:access_token"); err != ErrKeyNotFound {
+		t.Fatalf("过期后Get返回%v, 应为ErrKeyNotFound", err)
+	}
+}
+
+func TestKVCachePrefix(t *testing.T) {
+	store := newFakeKVStore()
+	a := NewKVCache(store, "a:")
+	b := NewKVCache(store, "b:")
+	a.Set("access_token", "token_a", 7200)
+	if _, err := b.Get("access_token"); err == nil {
+		t.Fatal("不同前缀的缓存不应共享值")
+	}
+	if got, _ := store.Get("a:access_token"); got != "token_a" {
+		t.Fatalf("存储中的key应带前缀, Get为%q", got)
+	}
+}
+
+// 多个进程(此处以多个实例模拟)共享同一缓存文件
+func TestFileCacheShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	a := NewFileCache(path)
+	b := NewFileCache(path)
+	a.Set("wx1:access_token", "token", 7200)
+	if got, err := b.Get("wx1:access_token"); err != nil || got != "token" {
+		t.Fatalf("另一实例Get为%q, %v", got, err)
+	}
+	b.Delete("wx1:access_token")
+	if _, err := a.Get("wx1:access_token"); err == nil {
+		t.Fatal("另一实例删除后Get应返回错误")
+	}
+
+	// 并发写入不同key, 加锁后不会互相覆盖
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := a
+			if i%2 == 1 {
+				c = b
+			}
+			if err := c.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), 7200); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		if got, err := a.Get(fmt.Sprintf("key%d", i)); err != nil || got != fmt.Sprintf("value%d", i) {
+			t.Fatalf("key%d为%q, %v", i, got, err)
+		}
+	}
+}
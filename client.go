@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,40 +10,95 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
-const apiURL = "https://api.weixin.qq.com/cgi-bin"
+const (
+	apiURL         = "https://api.weixin.qq.com/cgi-bin"
+	defaultTimeout = 10 * time.Second
+)
+
+const defaultTokenRefreshMargin = 5 * time.Minute
 
 type Client struct {
-	config Config
-	cache  Cache
+	config  Config
+	cache   Cache
+	baseURL string
+	http    *http.Client
+	// 同一时间只允许一个请求拉取AccessToken, 避免新Token使其他请求刚拉取的Token失效
+	tokenMu *sync.Mutex
 }
 
-func NewClient(cfg Config) Client {
+// cfg.HTTP中的代理地址错误时返回error
+func NewClient(cfg Config) (Client, error) {
 	var cache Cache
 	if cfg.Cache == nil {
 		cache = NewSimpleCache()
 	} else {
 		cache = cfg.Cache
 	}
-	return Client{
-		config: cfg,
-		cache:  cache,
+	if cfg.TokenRefreshMargin <= 0 {
+		cfg.TokenRefreshMargin = defaultTokenRefreshMargin
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	httpClient, err := cfg.HTTP.newHTTPClient(cfg.Timeout)
+	if err != nil {
+		return Client{}, fmt.Errorf("微信接口配置错误: %s", err)
 	}
+	return Client{
+		config:  cfg,
+		cache:   cache,
+		baseURL: strings.TrimRight(cfg.HTTP.baseURL(apiURL), "/"),
+		http:    httpClient,
+		tokenMu: &sync.Mutex{},
+	}, nil
+}
+
+// 缓存key, 以AppID为前缀, 多个公众号可共享同一缓存
+func (c Client) cacheKey(name string) string {
+	return c.config.AppID + ":" + name
 }
 
 func (c Client) getToken() (string, error) {
-	cacheValue, err := c.cache.Get()
+	key := c.cacheKey(CacheKeyAccessToken)
+	cacheValue, err := c.cache.Get(key)
 	// 缓存有效
 	if err == nil {
 		return cacheValue, nil
 	}
-	// 缓存已失效或为空, 拉取AccessToken
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	// 等待锁期间其他请求可能已拉取到新的AccessToken
+	if cacheValue, err := c.cache.Get(key); err == nil {
+		return cacheValue, nil
+	} else if _, ok := c.cache.(tokenOwner); ok {
+		// AccessToken由中心服务拉取, 不能自行拉取使其失效
+		return "", err
+	}
+	return c.fetchToken()
+}
+
+// 清除已失效的AccessToken, 若缓存已被其他请求刷新则保留
+func (c Client) invalidateToken(token string) {
+	key := c.cacheKey(CacheKeyAccessToken)
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	if cacheValue, err := c.cache.Get(key); err == nil && cacheValue != token {
+		return
+	}
+	c.cache.Delete(key)
+}
+
+// 拉取AccessToken并写入缓存, 缓存有效期比expires_in提前TokenRefreshMargin, 需持有tokenMu
+func (c Client) fetchToken() (string, error) {
 	values := url.Values{}
 	values.Add("grant_type", "client_credential")
 	values.Add("appid", c.config.AppID)
 	values.Add("secret", c.config.AppSecret)
-	resp, err := http.Get(apiURL + "/token?" + values.Encode())
+	resp, err := c.http.Get(c.baseURL + "/token?" + values.Encode())
 	if err != nil {
 		return "", fmt.Errorf("拉取AccessToken错误: %s", err)
 	}
@@ -50,6 +107,9 @@ func (c Client) getToken() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("拉取AccessToken错误: %s", err)
 	}
+	if err := checkErrCode(b); err != nil {
+		return "", fmt.Errorf("拉取AccessToken错误: %w", err)
+	}
 	j := struct {
 		AccessToken string `json:"access_token"`
 		ExpiresIn   int    `json:"expires_in"`
@@ -59,55 +119,221 @@ func (c Client) getToken() (string, error) {
 		return "", fmt.Errorf("拉取AccessToken错误: %s", b)
 	}
 	log.Printf("获取到AccessToken: %s\n", j.AccessToken)
-	c.cache.Set(j.AccessToken, j.ExpiresIn)
+	ttl := j.ExpiresIn - int(c.config.TokenRefreshMargin/time.Second)
+	if ttl <= 0 {
+		ttl = j.ExpiresIn / 2
+	}
+	c.cache.Set(c.cacheKey(CacheKeyAccessToken), j.AccessToken, ttl)
 	return j.AccessToken, nil
 }
 
+// 获取JS-SDK使用的jsapi_ticket
+func (c Client) GetJSAPITicket() (string, error) {
+	return c.getTicket("jsapi", CacheKeyJSAPITicket)
+}
+
+// 获取卡券使用的api_ticket
+func (c Client) GetCardTicket() (string, error) {
+	return c.getTicket("wx_card", CacheKeyCardTicket)
+}
+
+func (c Client) getTicket(ticketType string, name string) (string, error) {
+	key := c.cacheKey(name)
+	if cacheValue, err := c.cache.Get(key); err == nil {
+		return cacheValue, nil
+	} else if _, ok := c.cache.(tokenOwner); ok {
+		return "", err
+	}
+	j := struct {
+		Ticket    string `json:"ticket"`
+		ExpiresIn int    `json:"expires_in"`
+	}{}
+	if err := c.getJSON("/ticket/getticket?type="+ticketType, &j); err != nil {
+		return "", fmt.Errorf("拉取%s错误: %w", name, err)
+	}
+	ttl := j.ExpiresIn - int(c.config.TokenRefreshMargin/time.Second)
+	if ttl <= 0 {
+		ttl = j.ExpiresIn / 2
+	}
+	c.cache.Set(key, j.Ticket, ttl)
+	return j.Ticket, nil
+}
+
+// 在后台定期检查并提前刷新AccessToken, 直到ctx结束
+func (c Client) StartTokenRefresher(ctx context.Context) {
+	interval := c.config.TokenRefreshMargin / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := c.getToken(); err != nil {
+				log.Println("刷新AccessToken失败:", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
 func (c Client) get(path string) (string, error) {
+	return c.request(http.MethodGet, path, "")
+}
+
+func (c Client) post(path string, body string) (string, error) {
+	return c.request(http.MethodPost, path, body)
+}
+
+// 调用微信接口, 返回errcode不为0时返回APIError
+// AccessToken失效时清除缓存, 重新获取AccessToken后重试一次
+func (c Client) request(method string, path string, body string) (string, error) {
+	for retried := false; ; retried = true {
+		s, token, err := c.requestOnce(method, path, body)
+		if apiErr, ok := err.(APIError); ok && apiErr.TokenInvalid() && !retried {
+			log.Printf("AccessToken已失效, 重新获取: %s\n", apiErr)
+			c.invalidateToken(token)
+			continue
+		}
+		return s, err
+	}
+}
+
+// 返回响应和本次使用的AccessToken
+func (c Client) requestOnce(method string, path string, body string) (string, string, error) {
 	token, err := c.getToken()
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	u := c.baseURL + path + sep + "access_token=" + token
+	var r *http.Response
+	if method == http.MethodGet {
+		r, err = c.http.Get(u)
+	} else {
+		r, err = c.http.Post(u, "", strings.NewReader(body))
 	}
-	r, err := http.Get(apiURL + path + "?access_token=" + token)
 	if err != nil {
-		return "", fmt.Errorf("微信接口返回错误: %s", err)
+		return "", token, fmt.Errorf("微信接口返回错误: %s", err)
 	}
 	b, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
-		return "", fmt.Errorf("获取微信接口响应错误: %s", err)
+		return "", token, fmt.Errorf("获取微信接口响应错误: %s", err)
 	}
-	return string(b), nil
+	return string(b), token, checkErrCode(b)
 }
 
-func (c Client) post(path string, body string) (string, error) {
-	token, err := c.getToken()
-	if err != nil {
+// 检查响应中的errcode, 不为0时返回APIError, 非JSON响应(如媒体文件)不检查
+func checkErrCode(b []byte) error {
+	j := APIError{}
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil
+	}
+	if j.Code != ErrCodeOK {
+		return j
+	}
+	return nil
+}
+
+// 序列化请求体, 不转义URL中的&等字符
+func marshalJSON(v interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
 		return "", err
 	}
-	reader := strings.NewReader(body)
-	r, err := http.Post(apiURL+path+"?access_token="+token, "", reader)
-	if err != nil {
-		return "", fmt.Errorf("微信接口返回错误: %s", err)
+	return buf.String(), nil
+}
+
+// 解析微信接口响应, result为nil时不解析
+func decodeResult(s string, result interface{}) error {
+	if result == nil {
+		return nil
 	}
-	b, err := ioutil.ReadAll(r.Body)
-	defer r.Body.Close()
+	if err := json.Unmarshal([]byte(s), result); err != nil {
+		return fmt.Errorf("微信接口响应格式错误: %s", s)
+	}
+	return nil
+}
+
+// 调用GET接口并解析响应
+func (c Client) getJSON(path string, result interface{}) error {
+	s, err := c.get(path)
 	if err != nil {
-		return "", fmt.Errorf("获取微信接口响应错误: %s", err)
+		return err
 	}
-	return string(b), nil
+	return decodeResult(s, result)
 }
 
-func (c Client) SetMenu(menu string) error {
-	if s, err := c.post("/menu/create", menu); err != nil {
+// 调用POST接口并解析响应
+func (c Client) postJSON(path string, body interface{}, result interface{}) error {
+	b, err := marshalJSON(body)
+	if err != nil {
 		return err
-	} else if strings.Index(s, `"ok"`) == -1 {
-		return fmt.Errorf("创建菜单失败: %s", s)
-	} else {
-		return nil
 	}
+	s, err := c.post(path, b)
+	if err != nil {
+		return err
+	}
+	return decodeResult(s, result)
 }
 
-func (c Client) GetMenu() (string, error) {
-	return c.get("/menu/get")
+// 发送客服消息, 用于在被动回复超时后将回复推送给用户
+// 支持TextReply, ImageReply, VoiceReply, VideoReply, MusicReply和NewsReply
+func (c Client) SendCustomMessage(toUser string, reply Reply) error {
+	msg := map[string]interface{}{"touser": toUser}
+	switch r := reply.(type) {
+	case TextReply:
+		msg["msgtype"] = "text"
+		msg["text"] = map[string]string{"content": r.Content}
+	case ImageReply:
+		msg["msgtype"] = "image"
+		msg["image"] = map[string]string{"media_id": r.MediaID}
+	case VoiceReply:
+		msg["msgtype"] = "voice"
+		msg["voice"] = map[string]string{"media_id": r.MediaID}
+	case VideoReply:
+		msg["msgtype"] = "video"
+		msg["video"] = map[string]string{
+			"media_id":    r.MediaID,
+			"title":       r.Title,
+			"description": r.Description,
+		}
+	case MusicReply:
+		msg["msgtype"] = "music"
+		msg["music"] = map[string]string{
+			"title":          r.Title,
+			"description":    r.Description,
+			"musicurl":       r.MusicURL,
+			"hqmusicurl":     r.HQMusicUrl,
+			"thumb_media_id": r.ThumbMediaID,
+		}
+	case NewsReply:
+		articles := make([]map[string]string, len(r.Articles))
+		for i, item := range r.Articles {
+			articles[i] = map[string]string{
+				"title":       item.Title,
+				"description": item.Description,
+				"url":         item.URL,
+				"picurl":      item.PicURL,
+			}
+		}
+		msg["msgtype"] = "news"
+		msg["news"] = map[string]interface{}{"articles": articles}
+	default:
+		return fmt.Errorf("不支持的客服消息类型, reply=%s, type(reply)=%T", reply, reply)
+	}
+	if err := c.postJSON("/message/custom/send", msg, nil); err != nil {
+		return fmt.Errorf("发送客服消息失败: %w", err)
+	}
+	return nil
 }
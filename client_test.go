@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/speng4096/bing/wechattest"
+)
+
+// 连接模拟服务的Client, 使用独立的缓存
+func newTestClient(t *testing.T) (Client, *wechattest.Server) {
+	t.Helper()
+	srv := wechattest.NewServer("wx_test", "secret")
+	t.Cleanup(srv.Close)
+	client, err := NewClient(Config{
+		AppID:     "wx_test",
+		AppSecret: "secret",
+		Cache:     &SimpleCache{entries: map[string]cacheEntry{}},
+		HTTP:      HTTPOptions{BaseURL: srv.BaseURL()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, srv
+}
+
+func TestClientToken(t *testing.T) {
+	client, srv := newTestClient(t)
+	for i := 0; i < 3; i++ {
+		if err := client.SetMenu(menu); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// AccessToken缓存后复用
+	if n := srv.TokensIssued(); n != 1 {
+		t.Fatalf("发放了%d个AccessToken, 应为1个", n)
+	}
+	for _, call := range srv.CallsTo("/menu/create") {
+		if call.Query.Get("access_token") == "" {
+			t.Fatal("请求缺少access_token")
+		}
+	}
+}
+
+// 缓存为空时并发的请求只拉取一次AccessToken
+func TestClientTokenConcurrent(t *testing.T) {
+	client, srv := newTestClient(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.SetMenu(menu); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := srv.TokensIssued(); n != 1 {
+		t.Fatalf("发放了%d个AccessToken, 应为1个", n)
+	}
+}
+
+// AccessToken在expires_in前TokenRefreshMargin即视为过期
+func TestClientTokenRefreshMargin(t *testing.T) {
+	srv := wechattest.NewServer("wx_test", "secret")
+	t.Cleanup(srv.Close)
+	store := newFakeKVStore()
+	client, err := NewClient(Config{
+		AppID:              "wx_test",
+		AppSecret:          "secret",
+		Cache:              NewKVCache(store, ""),
+		TokenRefreshMargin: 10 * time.Minute,
+		HTTP:               HTTPOptions{BaseURL: srv.BaseURL()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetMenu(menu)
+	store.advance(srv.TokenTTL - 10*time.Minute - time.Second)
+	client.SetMenu(menu)
+	if n := srv.TokensIssued(); n != 1 {
+		t.Fatalf("距过期超过TokenRefreshMargin时发放了%d个AccessToken, 应为1个", n)
+	}
+	store.advance(2 * time.Second)
+	client.SetMenu(menu)
+	if n := srv.TokensIssued(); n != 2 {
+		t.Fatalf("距过期不足TokenRefreshMargin时发放了%d个AccessToken, 应为2个", n)
+	}
+}
+
+func TestClientTokenInvalid(t *testing.T) {
+	for _, code := range []int{wechattest.ErrCodeInvalidCredential, wechattest.ErrCodeAccessTokenExpired} {
+		client, srv := newTestClient(t)
+		if err := client.SetMenu(menu); err != nil {
+			t.Fatal(err)
+		}
+		// AccessToken失效时重新获取并重试一次
+		srv.InjectError("/menu/create", code)
+		if err := client.SetMenu(menu); err != nil {
+			t.Fatalf("%d: %s", code, err)
+		}
+		if n := len(srv.CallsTo("/menu/create")); n != 3 {
+			t.Fatalf("%d: 调用/menu/create %d次, 应为3次", code, n)
+		}
+		if n := srv.TokensIssued(); n != 2 {
+			t.Fatalf("%d: 发放了%d个AccessToken, 应为2个", code, n)
+		}
+	}
+
+	// 服务端使AccessToken过期
+	client, srv := newTestClient(t)
+	client.SetMenu(menu)
+	srv.ExpireTokens()
+	if _, err := client.GetMenu(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重试后仍失效时返回错误, 不无限重试
+	srv.InjectError("/menu/get", wechattest.ErrCodeInvalidCredential)
+	srv.InjectError("/menu/get", wechattest.ErrCodeInvalidCredential)
+	_, err := client.GetMenu()
+	var apiErr APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != ErrCodeInvalidCredential {
+		t.Fatalf("返回%v, 应为40001", err)
+	}
+}
+
+func TestClientAPIError(t *testing.T) {
+	client, srv := newTestClient(t)
+	srv.InjectError("/menu/create", wechattest.ErrCodeAPIRateLimit)
+	err := client.SetMenu(menu)
+	var apiErr APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != ErrCodeAPIRateLimit {
+		t.Fatalf("返回%v, 应为45009", err)
+	}
+	// 与AccessToken无关的错误不重试
+	if n := len(srv.CallsTo("/menu/create")); n != 1 {
+		t.Fatalf("调用/menu/create %d次, 应为1次", n)
+	}
+}
+
+func TestClientMenu(t *testing.T) {
+	client, srv := newTestClient(t)
+	if _, err := client.GetMenu(); err == nil {
+		t.Fatal("未创建菜单时应返回错误")
+	}
+	if err := client.SetMenu(menu); err != nil {
+		t.Fatal(err)
+	}
+	info, err := client.GetMenu()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info.Menu.Buttons, menu.Buttons) {
+		t.Fatalf("查询到的菜单为%+v, 应为%+v", info.Menu.Buttons, menu.Buttons)
+	}
+
+	self, err := client.GetCurrentSelfMenuInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buttons := self.Info.Buttons
+	if len(buttons) != 2 || buttons[0].Key != "Start" || len(buttons[1].SubButton.List) != 3 || buttons[1].SubButton.List[0].Key != "Yes" {
+		t.Fatalf("当前菜单错误: %+v", buttons)
+	}
+
+	if err := client.DeleteMenu(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Menu() != nil {
+		t.Fatal("菜单未删除")
+	}
+}
+
+func TestClientSendCustomMessage(t *testing.T) {
+	client, srv := newTestClient(t)
+	if err := client.SendCustomMessage("oUser", TextReply{Content: "a&b<c>"}); err != nil {
+		t.Fatal(err)
+	}
+	messages := srv.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("发送了%d条客服消息, 应为1条", len(messages))
+	}
+	// 请求体不转义&<>
+	if !strings.Contains(string(messages[0]), "a&b<c>") {
+		t.Fatalf("客服消息被转义: %s", messages[0])
+	}
+	msg := struct {
+		ToUser string `json:"touser"`
+		Text   struct {
+			Content string `json:"content"`
+		} `json:"text"`
+	}{}
+	json.Unmarshal(messages[0], &msg)
+	if msg.ToUser != "oUser" || msg.Text.Content != "a&b<c>" {
+		t.Fatalf("客服消息错误: %s", messages[0])
+	}
+}
+
+func TestNewClientConfig(t *testing.T) {
+	if _, err := NewClient(Config{HTTP: HTTPOptions{Proxy: "127.0.0.1:8080"}}); err == nil {
+		t.Fatal("代理地址错误时应返回error")
+	}
+
+	// 模板未设置超时时使用Config.Timeout
+	client, err := NewClient(Config{Timeout: 3 * time.Second, HTTP: HTTPOptions{HTTPClient: &http.Client{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.http.Timeout != 3*time.Second {
+		t.Fatalf("超时为%s, 应为3s", client.http.Timeout)
+	}
+	client, _ = NewClient(Config{Timeout: 3 * time.Second, HTTP: HTTPOptions{HTTPClient: &http.Client{Timeout: time.Second}}})
+	if client.http.Timeout != time.Second {
+		t.Fatalf("超时为%s, 应保留模板的1s", client.http.Timeout)
+	}
+}
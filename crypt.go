@@ -15,18 +15,99 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// 消息时间戳允许的偏差, 超出视为重放
+const replayWindow = 5 * time.Minute
+
+// 消息加解密错误, Code与微信官方加解密库一致
+type CryptError struct {
+	Code int
+	Msg  string
+}
+
+func (e CryptError) Error() string {
+	return fmt.Sprintf("消息加解密错误(%d): %s", e.Code, e.Msg)
+}
+
+var (
+	ErrSignature = CryptError{Code: -40001, Msg: "签名验证错误"}
+	ErrParseXML  = CryptError{Code: -40002, Msg: "xml解析失败"}
+	ErrAppID     = CryptError{Code: -40005, Msg: "AppID校验错误"}
+	ErrDecrypt   = CryptError{Code: -40007, Msg: "aes解密失败"}
+	ErrPadding   = CryptError{Code: -40008, Msg: "PKCS7补位错误"}
+	ErrBase64    = CryptError{Code: -40010, Msg: "base64解码失败"}
+	ErrReplay    = CryptError{Code: -40012, Msg: "时间戳过期或消息重放"}
+)
+
 type MsgCrypt struct {
 	Config
 	aesKey []byte
 	iv     []byte
+	replay *replayGuard
+}
+
+// 记录窗口期内已处理的timestamp+nonce, 用于拒绝重放消息
+// 微信重试时会原样重发同一请求, 因此同一timestamp+nonce允许重发相同的密文,
+// 重发的消息由排重层(replyCache)返回首次生成的回复, 不会重复处理
+type replayGuard struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]replayEntry
+	swept  time.Time
+}
+
+type replayEntry struct {
+	encrypt string
+	expire  time.Time
+}
+
+func newReplayGuard(window time.Duration) *replayGuard {
+	return &replayGuard{
+		window: window,
+		seen:   map[string]replayEntry{},
+		swept:  time.Now(),
+	}
+}
+
+// 检查时间戳是否在窗口期内, 且timestamp+nonce未用于其他密文
+func (g *replayGuard) check(timestamp string, nonce string, encrypt string) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrReplay
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(ts, 0)); d > g.window || d < -g.window {
+		return ErrReplay
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// 定期清理过期记录
+	if now.Sub(g.swept) > g.window {
+		for k, entry := range g.seen {
+			if entry.expire.Before(now) {
+				delete(g.seen, k)
+			}
+		}
+		g.swept = now
+	}
+	key := timestamp + ":" + nonce
+	if entry, ok := g.seen[key]; ok && entry.expire.After(now) {
+		if entry.encrypt != encrypt {
+			return ErrReplay
+		}
+		return nil
+	}
+	g.seen[key] = replayEntry{encrypt: encrypt, expire: now.Add(2 * g.window)}
+	return nil
 }
 
 func NewMsgCrypt(cfg Config) (MsgCrypt, error) {
 	crypt := MsgCrypt{
 		Config: cfg,
+		replay: newReplayGuard(replayWindow),
 	}
 	b64Key := []byte(crypt.EncodingAESKey + "=")
 	key := make([]byte, base64.StdEncoding.DecodedLen(len(b64Key)))
@@ -44,14 +125,21 @@ func NewMsgCrypt(cfg Config) (MsgCrypt, error) {
 }
 
 // 用于删除解密后明文的补位字符
-func (m MsgCrypt) decodePKCS7(text []byte) []byte {
+func (m MsgCrypt) decodePKCS7(text []byte) ([]byte, error) {
+	if len(text) == 0 {
+		return nil, ErrPadding
+	}
 	pad := int(text[len(text)-1])
-
-	if pad < 1 || pad > 32 {
-		pad = 0
+	if pad < 1 || pad > 32 || pad > len(text) {
+		return nil, ErrPadding
+	}
+	for _, b := range text[len(text)-pad:] {
+		if int(b) != pad {
+			return nil, ErrPadding
+		}
 	}
 
-	return text[:len(text)-pad]
+	return text[:len(text)-pad], nil
 }
 
 // 用于对需要加密的明文进行填充补位
@@ -77,31 +165,57 @@ func (m MsgCrypt) GetSignature(timestamp string, nonce string, msgEncrypt string
 	return fmt.Sprintf("%x", hash.Sum(nil))
 }
 
-//  微信消息解密
-func (m *MsgCrypt) Decrypt(xmlEncrypt *[]byte, msgSignature string) ([]byte, error) {
-	var msgLen int32
+// 微信消息解密
+// 依次校验msg_signature、时间戳重放、PKCS7补位和消息尾部的AppID, 失败时返回CryptError
+func (m *MsgCrypt) Decrypt(xmlEncrypt *[]byte, timestamp string, nonce string, msgSignature string) ([]byte, error) {
+	var msgLen uint32
 	// xml解码
 	encryptMessage := EncryptMessage{}
-	xml.Unmarshal(*xmlEncrypt, &encryptMessage)
+	if err := xml.Unmarshal(*xmlEncrypt, &encryptMessage); err != nil || encryptMessage.Encrypt == "" {
+		return nil, ErrParseXML
+	}
+	// 验签
+	if m.GetSignature(timestamp, nonce, encryptMessage.Encrypt) != msgSignature {
+		return nil, ErrSignature
+	}
+	// 防重放
+	if m.replay != nil {
+		if err := m.replay.check(timestamp, nonce, encryptMessage.Encrypt); err != nil {
+			return nil, err
+		}
+	}
 	// base64解码
 	deciphered, err := base64.StdEncoding.DecodeString(encryptMessage.Encrypt)
 	if err != nil {
-		return nil, err
+		return nil, ErrBase64
 	}
 	// aes解码
+	if len(deciphered) == 0 || len(deciphered)%aes.BlockSize != 0 {
+		return nil, ErrDecrypt
+	}
 	c, err := aes.NewCipher(m.aesKey)
 	if err != nil {
-		return nil, err
+		return nil, ErrDecrypt
 	}
 	cbc := cipher.NewCBCDecrypter(c, m.iv)
 	cbc.CryptBlocks(deciphered, deciphered)
-	decoded := m.decodePKCS7(deciphered)
+	decoded, err := m.decodePKCS7(deciphered)
+	if err != nil {
+		return nil, err
+	}
+	// 16字节随机串 + 4字节消息长度 + 消息 + AppID
+	if len(decoded) < 20 {
+		return nil, ErrDecrypt
+	}
 	buf := bytes.NewBuffer(decoded[16:20])
 	binary.Read(buf, binary.BigEndian, &msgLen)
-	if int(20+msgLen) > len(decoded) {
-		return nil, fmt.Errorf("消息解密错误")
+	if uint64(msgLen) > uint64(len(decoded)-20) {
+		return nil, ErrDecrypt
 	}
 	msgDecrypt := decoded[20 : 20+msgLen]
+	if string(decoded[20+msgLen:]) != m.AppID {
+		return nil, ErrAppID
+	}
 	return msgDecrypt, nil
 }
 
@@ -139,12 +253,17 @@ func (m *MsgCrypt) Encrypt(xmlBytes *[]byte) ([]byte, error) {
 	return xml.Marshal(encryptReply)
 }
 
-// 微信接口验签
-func CheckSignature(cfg Config, timestamp string, nonce string, signature string) bool {
+// 微信接口签名
+func MakeSignature(cfg Config, timestamp string, nonce string) string {
 	items := []string{cfg.Token, timestamp, nonce}
 	sort.Strings(items)
 	hash := sha1.New()
 
 	io.WriteString(hash, strings.Join(items, ""))
-	return fmt.Sprintf("%x", hash.Sum(nil)) == signature
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// 微信接口验签
+func CheckSignature(cfg Config, timestamp string, nonce string, signature string) bool {
+	return MakeSignature(cfg, timestamp, nonce) == signature
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testCryptConfig = Config{
+	AppID:          "wx0123456789abcdef",
+	Token:          "token",
+	EncodingAESKey: "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG",
+}
+
+func newTestCrypt(t *testing.T) *MsgCrypt {
+	t.Helper()
+	crypt, err := NewMsgCrypt(testCryptConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &crypt
+}
+
+func TestEncryptReplyRoot(t *testing.T) {
+	plain := []byte("<xml><Content>你好</Content></xml>")
+	b, err := newTestCrypt(t).Encrypt(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 被动回复的根元素必须为<xml>
+	if !bytes.HasPrefix(b, []byte("<xml>")) || !bytes.HasSuffix(b, []byte("</xml>")) {
+		t.Fatalf("加密回复的根元素错误: %s", b)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	crypt := newTestCrypt(t)
+	plain := []byte("<xml><Content>你好</Content></xml>")
+	b, err := crypt.Encrypt(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := EncryptReply{}
+	if err := xml.Unmarshal(b, &reply); err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := crypt.Decrypt(&b, reply.TimeStamp, reply.Nonce, reply.MsgSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Fatalf("解密结果为%s, 应为%s", decrypted, plain)
+	}
+	// 微信重试时原样重发
+	if _, err := crypt.Decrypt(&b, reply.TimeStamp, reply.Nonce, reply.MsgSignature); err != nil {
+		t.Fatalf("重发的消息解密失败: %s", err)
+	}
+	if _, err := crypt.Decrypt(&b, reply.TimeStamp, reply.Nonce, "bad"); err != ErrSignature {
+		t.Fatalf("错误签名返回%v, 应为ErrSignature", err)
+	}
+}
+
+// 加密明文并按给定的timestamp、nonce签名, 构造微信推送的加密消息
+// tamper不为nil时在签名前修改密文
+func sealMessage(t *testing.T, crypt *MsgCrypt, plain []byte, timestamp string, nonce string, tamper func(ciphertext []byte)) ([]byte, string) {
+	t.Helper()
+	b, err := crypt.Encrypt(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := EncryptReply{}
+	if err := xml.Unmarshal(b, &reply); err != nil {
+		t.Fatal(err)
+	}
+	encrypt := reply.Encrypt
+	if tamper != nil {
+		ciphertext, _ := base64.StdEncoding.DecodeString(encrypt)
+		tamper(ciphertext)
+		encrypt = base64.StdEncoding.EncodeToString(ciphertext)
+	}
+	body := []byte("<xml><ToUserName><![CDATA[gh_test]]></ToUserName><Encrypt><![CDATA[" + encrypt + "]]></Encrypt></xml>")
+	return body, crypt.GetSignature(timestamp, nonce, encrypt)
+}
+
+func TestDecryptErrors(t *testing.T) {
+	crypt := newTestCrypt(t)
+	plain := []byte("<xml><Content>你好</Content></xml>")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// 其他公众号的消息
+	other := testCryptConfig
+	other.AppID = "wx_other"
+	otherCrypt, err := NewMsgCrypt(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, sig := sealMessage(t, &otherCrypt, plain, now, "1", nil)
+	if _, err := crypt.Decrypt(&body, now, "1", sig); err != ErrAppID {
+		t.Fatalf("AppID不符返回%v, 应为ErrAppID", err)
+	}
+
+	// 修改倒数第二个密文块的末字节, CBC解密后最后一块的补位字节随之改变
+	body, sig = sealMessage(t, crypt, plain, now, "2", func(ciphertext []byte) {
+		ciphertext[len(ciphertext)-17] ^= 0xff
+	})
+	if _, err := crypt.Decrypt(&body, now, "2", sig); err != ErrPadding {
+		t.Fatalf("补位错误返回%v, 应为ErrPadding", err)
+	}
+
+	// 时间戳超出窗口期
+	for _, d := range []time.Duration{-replayWindow - time.Minute, replayWindow + time.Minute} {
+		ts := strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+		body, sig = sealMessage(t, crypt, plain, ts, "3", nil)
+		if _, err := crypt.Decrypt(&body, ts, "3", sig); err != ErrReplay {
+			t.Fatalf("时间戳偏差%s返回%v, 应为ErrReplay", d, err)
+		}
+	}
+
+	// 同一timestamp+nonce用于不同的密文
+	body, sig = sealMessage(t, crypt, plain, now, "4", nil)
+	if _, err := crypt.Decrypt(&body, now, "4", sig); err != nil {
+		t.Fatal(err)
+	}
+	body, sig = sealMessage(t, crypt, []byte("<xml><Content>再见</Content></xml>"), now, "4", nil)
+	if _, err := crypt.Decrypt(&body, now, "4", sig); err != ErrReplay {
+		t.Fatalf("重放返回%v, 应为ErrReplay", err)
+	}
+}
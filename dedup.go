@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// 消息排重, 微信在5秒内未收到回复时会重试3次
+// 相同key的消息只处理一次, 重试的请求等待首次处理完成后返回同一回复
+type replyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*replyEntry
+	swept   time.Time
+}
+
+var errReplyPanic = errors.New("处理消息panic")
+
+type replyEntry struct {
+	done   chan struct{} // 处理完成后关闭
+	resp   []byte
+	err    error
+	expire time.Time
+}
+
+func newReplyCache(ttl time.Duration) *replyCache {
+	return &replyCache{
+		ttl:     ttl,
+		entries: map[string]*replyEntry{},
+		swept:   time.Now(),
+	}
+}
+
+// 处理key对应的消息, 同一key在ttl内只调用一次fn
+// key为空时不排重
+func (d *replyCache) Do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	if key == "" {
+		return fn()
+	}
+	now := time.Now()
+	d.mu.Lock()
+	d.sweep(now)
+	if entry, ok := d.entries[key]; ok && entry.expire.After(now) {
+		d.mu.Unlock()
+		<-entry.done
+		return entry.resp, entry.err
+	}
+	entry := &replyEntry{done: make(chan struct{}), expire: now.Add(d.ttl)}
+	d.entries[key] = entry
+	d.mu.Unlock()
+
+	// fn panic时也关闭done, 等待中的重试得到errReplyPanic而不会一直阻塞
+	entry.err = errReplyPanic
+	defer close(entry.done)
+	entry.resp, entry.err = fn()
+	return entry.resp, entry.err
+}
+
+// 清理过期记录, 需持有锁
+func (d *replyCache) sweep(now time.Time) {
+	if now.Sub(d.swept) < d.ttl {
+		return
+	}
+	for k, entry := range d.entries {
+		if entry.expire.Before(now) {
+			delete(d.entries, k)
+		}
+	}
+	d.swept = now
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 重试的请求等待首次处理完成, 得到同一回复
+func TestReplyCacheConcurrent(t *testing.T) {
+	d := newReplyCache(time.Minute)
+	var calls int32
+	release := make(chan struct{})
+	fn := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("reply"), nil
+	}
+	var wg sync.WaitGroup
+	results := make([][]byte, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = d.Do("key", fn)
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("fn调用了%d次, 应为1次", n)
+	}
+	for i, resp := range results {
+		if string(resp) != "reply" {
+			t.Fatalf("第%d个请求得到%q, 应为reply", i, resp)
+		}
+	}
+}
+
+func TestReplyCacheTTL(t *testing.T) {
+	d := newReplyCache(50 * time.Millisecond)
+	var calls int
+	fn := func() ([]byte, error) {
+		calls++
+		return []byte("reply"), nil
+	}
+	d.Do("a", fn)
+	d.Do("a", fn)
+	d.Do("b", fn)
+	if calls != 2 {
+		t.Fatalf("fn调用了%d次, 每个key应只调用1次", calls)
+	}
+	// 超过ttl后重新处理
+	time.Sleep(60 * time.Millisecond)
+	d.Do("a", fn)
+	if calls != 3 {
+		t.Fatalf("fn调用了%d次, 过期后应重新调用", calls)
+	}
+
+	// key为空时不排重
+	calls = 0
+	d.Do("", fn)
+	d.Do("", fn)
+	if calls != 2 {
+		t.Fatalf("fn调用了%d次, key为空时应每次调用", calls)
+	}
+}
+
+// fn panic后, 重试的请求不会一直阻塞
+func TestReplyCachePanic(t *testing.T) {
+	d := newReplyCache(time.Minute)
+	started := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		d.Do("key", func() ([]byte, error) {
+			close(started)
+			time.Sleep(20 * time.Millisecond)
+			panic("boom")
+		})
+	}()
+	<-started
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.Do("key", func() ([]byte, error) { return nil, nil })
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != errReplyPanic {
+			t.Fatalf("返回%v, 应为errReplyPanic", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fn panic后重试的请求一直阻塞")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "fmt"
+
+// 微信接口全局返回码
+const (
+	ErrCodeSystemBusy         = -1    // 系统繁忙
+	ErrCodeOK                 = 0     // 请求成功
+	ErrCodeInvalidCredential  = 40001 // AppSecret错误或AccessToken无效
+	ErrCodeInvalidGrantType   = 40002 // 不合法的凭证类型
+	ErrCodeInvalidOpenID      = 40003 // 不合法的OpenID
+	ErrCodeInvalidMediaType   = 40004 // 不合法的媒体文件类型
+	ErrCodeInvalidMediaID     = 40007 // 不合法的媒体文件id
+	ErrCodeInvalidAppID       = 40013 // 不合法的AppID
+	ErrCodeInvalidAccessToken = 40014 // 不合法的AccessToken
+	ErrCodeInvalidButtonCount = 40016 // 不合法的按钮个数
+	ErrCodeInvalidButtonType  = 40017 // 不合法的按钮类型
+	ErrCodeInvalidButtonName  = 40018 // 不合法的按钮名字长度
+	ErrCodeInvalidButtonKey   = 40019 // 不合法的按钮KEY长度
+	ErrCodeInvalidButtonURL   = 40020 // 不合法的按钮URL长度
+	ErrCodeInvalidAppSecret   = 40125 // 不合法的AppSecret
+	ErrCodeIPNotInWhitelist   = 40164 // 调用接口的IP地址不在白名单中
+	ErrCodeMissingToken       = 41001 // 缺少AccessToken参数
+	ErrCodeAccessTokenExpired = 42001 // AccessToken超时
+	ErrCodeAPIRateLimit       = 45009 // 接口调用超过限制
+	ErrCodeReplyTimeLimit     = 45015 // 回复时间超过限制
+	ErrCodeAPIUnauthorized    = 48001 // api功能未授权
+	ErrCodeMenuNotExist       = 46003 // 不存在的菜单数据
+)
+
+// 微信接口返回的错误
+type APIError struct {
+	Code int    `json:"errcode"`
+	Msg  string `json:"errmsg"`
+}
+
+func (e APIError) Error() string {
+	return fmt.Sprintf("微信接口返回错误(%d): %s", e.Code, e.Msg)
+}
+
+// AccessToken失效, 需要重新获取
+func (e APIError) TokenInvalid() bool {
+	switch e.Code {
+	case ErrCodeInvalidCredential, ErrCodeInvalidAccessToken, ErrCodeAccessTokenExpired:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// Windows下不支持flock, 仅保证单进程内的读写
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
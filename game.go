@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// simplechat/getresponse请求体
+type BingRequest struct {
+	SenderID string      `json:"SenderId"`
+	Content  BingContent `json:"Content"`
+}
+
+// simplechat/getresponse响应中的一条消息
+type BingMessage struct {
+	Content BingContent `json:"Content"`
+}
+
+// 消息内容, 一条消息可同时包含文本、图片、卡片和建议回复
+type BingContent struct {
+	Text             string            `json:"Text"`
+	Image            string            `json:"Image"`
+	Card             *BingCard         `json:"Card,omitempty"`
+	SuggestedReplies []string          `json:"SuggestedReplies,omitempty"`
+	Metadata         map[string]string `json:"Metadata,omitempty"`
+}
+
+// 卡片消息
+type BingCard struct {
+	Title       string `json:"Title"`
+	Description string `json:"Description"`
+	Image       string `json:"Image"`
+	URL         string `json:"Url"`
+}
+
+// 小冰响应格式与BingMessage不符, 通常意味着上游接口已变更
+type SchemaError struct {
+	Raw []byte
+	Err error
+}
+
+func (e SchemaError) Error() string {
+	raw := e.Raw
+	if len(raw) > 200 {
+		raw = raw[:200]
+	}
+	return fmt.Sprintf("小冰响应格式错误: %s, 响应: %s", e.Err, raw)
+}
+
+// 读心术游戏的一轮回复
+type GameTurn struct {
+	Index       int           // 问题序号, 从1开始, 按本地计数; 本轮不是提问时为0
+	Question    string        // 问题文本
+	Guess       string        // 小冰猜测的人名, 未猜测时为空
+	GuessImage  string        // 猜测人物的图片URL
+	End         bool          // 本局游戏是否已结束
+	Text        string        // 全部回复文本, 以空格连接
+	Suggestions []string      // 建议回复
+	Messages    []BingMessage // 解码后的全部消息
+	Raw         []byte        // 原始响应
+}
+
+var (
+	indexRe = regexp.MustCompile(`第\s*(\d+)\s*[题问]|[(（【\[]\s*(\d+)\s*/\s*\d+\s*[)）】\]]`)
+	guessRe = regexp.MustCompile(`我猜[^是]*是[：:]?\s*[「“"]?([^」”"，,。！!？?\s]+)`)
+	endRe   = regexp.MustCompile(`再来一[局次]|游戏结束|重新开始`)
+)
+
+// 解码小冰的响应
+func decodeMessages(raw []byte) ([]BingMessage, error) {
+	var messages []BingMessage
+	raw = bytes.TrimSpace(raw)
+	// 兼容单条消息直接返回对象的情况
+	if len(raw) > 0 && raw[0] == '{' {
+		var message BingMessage
+		if err := json.Unmarshal(raw, &message); err != nil {
+			return nil, SchemaError{Raw: raw, Err: err}
+		}
+		messages = []BingMessage{message}
+	} else if err := json.Unmarshal(raw, &messages); err != nil {
+		return nil, SchemaError{Raw: raw, Err: err}
+	}
+	for _, m := range messages {
+		c := m.Content
+		if c.Text != "" || c.Image != "" || c.Card != nil || len(c.SuggestedReplies) > 0 {
+			return messages, nil
+		}
+	}
+	return nil, SchemaError{Raw: raw, Err: fmt.Errorf("响应中没有可识别的消息内容")}
+}
+
+// 解析小冰的响应, lastIndex为上一个问题的序号
+// 小冰的响应中没有已确认的题号字段, 按lastIndex+1本地计数, 遇到追问、重发或从过期状态恢复的会话时可能偏差;
+// 问题文本中写明"第N题"或"(N/15)"时以文本为准, 与用户看到的题号一致
+func parseTurn(raw []byte, lastIndex int) (GameTurn, error) {
+	turn := GameTurn{Raw: raw}
+	messages, err := decodeMessages(raw)
+	if err != nil {
+		return turn, err
+	}
+	turn.Messages = messages
+	var texts []string
+	var image string
+	for _, m := range messages {
+		c := m.Content
+		text := c.Text
+		if c.Card != nil {
+			if text == "" {
+				text = c.Card.Title
+			}
+			if image == "" {
+				image = c.Card.Image
+			}
+		}
+		if image == "" {
+			image = c.Image
+		}
+		turn.Suggestions = append(turn.Suggestions, c.SuggestedReplies...)
+		if text == "" {
+			continue
+		}
+		texts = append(texts, text)
+		if items := guessRe.FindStringSubmatch(text); items != nil {
+			turn.Guess = items[1]
+			if c.Image != "" {
+				image = c.Image
+			}
+		}
+		if endRe.MatchString(text) {
+			turn.End = true
+		}
+	}
+	if len(texts) == 0 {
+		return turn, ErrBingNoAnswer
+	}
+	turn.Text = strings.Join(texts, " ")
+	// 猜测时附带人物图片
+	if turn.Guess != "" {
+		turn.GuessImage = image
+		turn.End = true
+	}
+	if turn.End {
+		return turn, nil
+	}
+	// 最后一条以问号结尾的文本为本轮问题
+	for i := len(texts) - 1; i >= 0; i-- {
+		if strings.HasSuffix(texts[i], "？") || strings.HasSuffix(texts[i], "?") {
+			turn.Question = texts[i]
+			break
+		}
+	}
+	if turn.Question == "" {
+		return turn, nil
+	}
+	if index, ok := questionIndex(turn.Question); ok {
+		turn.Index = index
+	} else {
+		turn.Index = lastIndex + 1
+	}
+	return turn, nil
+}
+
+// 取出问题文本中的"第N题"、"(N/15)", 没有时返回false
+func questionIndex(question string) (int, bool) {
+	if items := indexRe.FindStringSubmatch(question); items != nil {
+		for _, item := range items[1:] {
+			if index, err := strconv.Atoi(item); err == nil && index > 0 {
+				return index, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/speng4096/bing/bingtest"
+)
+
+// 用户输入原样拼入请求体曾导致引号、反斜杠和换行破坏JSON
+// 经Send发给模拟服务, 服务端解析出的Text应与输入一致
+func FuzzBingRequest(f *testing.F) {
+	for _, seed := range []string{
+		"是",
+		`他说"你好"`,
+		`C:\Users\bing`,
+		"第一行\n第二行",
+		`"}],"Metadata":{"Q20H5Enter":"true"}`,
+		"\\\"\n\t\u2028",
+	} {
+		f.Add(seed)
+	}
+	srv := bingtest.NewServer(bingtest.Linear(15, "周杰伦"))
+	defer srv.Close()
+	ctx := context.Background()
+	bing, err := NewBing(ctx, testBingOptions(srv))
+	if err != nil {
+		f.Fatal(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	f.Fuzz(func(t *testing.T, s string) {
+		// 微信消息经XML解码, 不会包含非法UTF-8
+		if !utf8.ValidString(s) {
+			t.Skip()
+		}
+		n := len(srv.Calls())
+		// 回复可能不是游戏问题, 只检查请求
+		bing.Send(ctx, s)
+		calls := srv.Calls()
+		if len(calls) != n+1 {
+			t.Fatalf("发出%d个请求, 应为1个", len(calls)-n)
+		}
+		if calls[n].Text != s {
+			t.Fatalf("服务端收到%q, 应为%q", calls[n].Text, s)
+		}
+	})
+}
+
+func TestParseTurnIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		lastIndex int
+		index     int
+	}{
+		{"第N题", `[{"Content":{"Text":"第5题：他是男的吗？"}}]`, 0, 5},
+		{"N/15", `[{"Content":{"Text":"(3/15) 他是男的吗？"}}]`, 9, 3},
+		{"按本地计数", `[{"Content":{"Text":"他是男的吗？"}}]`, 4, 5},
+		{"不是提问", `[{"Content":{"Text":"请回答是、不是或不知道哦"}}]`, 4, 0},
+		{"猜测", `[{"Content":{"Text":"我猜你想的是：周杰伦","Image":"http://example.com/1.jpg"}},{"Content":{"Text":"猜对了吗？"}}]`, 15, 0},
+	}
+	for _, tt := range tests {
+		turn, err := parseTurn([]byte(tt.raw), tt.lastIndex)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if turn.Index != tt.index {
+			t.Errorf("%s: Index为%d, 应为%d", tt.name, turn.Index, tt.index)
+		}
+	}
+}
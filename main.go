@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
 )
 
 // TODO: 替换开发者信息（明文模式）
@@ -16,65 +20,202 @@ var config = Config{
 	Token:     "",
 }
 
-// 用户会话
-var sessions = map[string]Bing{}
+// 消息排重, 与加密消息的防重放窗口一致, 窗口期内重放的消息只会得到缓存的回复
+var replies = newReplyCache(replayWindow)
+
+// 微信接口, 在main中根据config创建
+var client Client
+
+// 中心AccessToken服务, 监听地址不为空时对内网提供AccessToken
+// 其他服务使用NewRemoteCache(地址, tokenServerSecret)作为Config.Cache
+var (
+	tokenServerAddr   = ""
+	tokenServerSecret = ""
+)
+
+// 消息加解密, 未配置EncodingAESKey时为nil
+var crypt *MsgCrypt
+
+// 用户会话, 空闲30分钟后淘汰, 最多保留10000个
+// 多副本或滚动部署时可改用共享目录的NewFileSessionStore, 会话在进程间恢复
+var sessions SessionStore = NewMemorySessionStore(30*time.Minute, 10000)
+
+// 同一用户的游戏交互依次进行
+var sessionLocks = newUserLocks()
 
 // 自定义菜单
-const menu = `{"button":[{"type":"click","name":"开始游戏","key":"Start"},
-{"name":"选择回答","sub_button":[{"type":"click","name":"是","key":"Yes"},
-{"type":"click","name":"否","key":"No"},{"type":"click","name":"不知道","key":"Pass"}]}]}`
+var menu = Menu{Buttons: []Button{
+	ClickButton("开始游戏", "Start"),
+	SubMenu("选择回答",
+		ClickButton("是", "Yes"),
+		ClickButton("否", "No"),
+		ClickButton("不知道", "Pass"),
+	),
+}}
+
+// 小冰接口选项
+var bingOptions = BingOptions{}
+
+// 被动回复的等待时间, 微信要求5秒内回复, 超时后先回复success, 再通过客服消息发送
+var replyBudget = 4 * time.Second
+
+// 生成回复的最长时间, 包含超时后异步生成的时间
+const replyTimeout = 30 * time.Second
+
+// 开始新游戏, 替换用户原有会话
+func startGame(ctx context.Context, uid string) string {
+	defer sessionLocks.Lock(uid)()
+	bing, err := NewBing(ctx, bingOptions)
+	if err != nil {
+		log.Println("新建会话失败:", err)
+		return "小冰崩溃了 :-("
+	}
+	turn, err := bing.Send(ctx, "开始")
+	if err != nil {
+		return bingErrorText(err)
+	}
+	saveSession(uid, bing)
+	return turn.Text
+}
+
+// 取出用户会话, 会话不存在或已过期时新建
+func loadSession(ctx context.Context, uid string) (Bing, error) {
+	if bing, err := sessions.Get(uid); err == nil {
+		return bing, nil
+	}
+	return NewBing(ctx, bingOptions)
+}
+
+// 保存交互后的用户会话
+func saveSession(uid string, bing Bing) {
+	if err := sessions.Put(uid, bing); err != nil {
+		log.Println("保存会话失败:", err)
+	}
+}
 
-// 根据用户发送的消息生成回复
-func getResponse(header *MessageHeader, msg Message) ([]byte, error) {
-	// 初始会话
+// 在用户会话中进行一轮交互, 返回回复用户的文本
+func play(ctx context.Context, uid string, fn func(bing *Bing) (GameTurn, error)) string {
+	defer sessionLocks.Lock(uid)()
+	bing, err := loadSession(ctx, uid)
+	if err != nil {
+		log.Println("新建会话失败:", err)
+		return "小冰崩溃了 :-("
+	}
+	turn, err := fn(&bing)
+	if err == ErrBingExpired {
+		sessions.Delete(uid)
+	}
+	if err != nil {
+		return bingErrorText(err)
+	}
+	saveSession(uid, bing)
+	return turn.Text
+}
+
+// 小冰接口错误时回复用户的文本
+func bingErrorText(err error) string {
+	log.Println("小冰接口错误:", err)
+	if _, ok := err.(SchemaError); ok {
+		return ErrBingNoAnswer.Error()
+	}
+	return err.Error()
+}
+
+// 消息路由
+var mux = newMux()
+
+func newMux() *Mux {
+	m := NewMux()
+	m.OnText(onText)
+	m.OnEvent("subscribe", onSubscribe)
+	m.OnEvent("unsubscribe", onUnsubscribe)
+	m.OnMenuClick("Start", onStart)
+	m.OnMenuClick("Yes", onAnswer(Yes))
+	m.OnMenuClick("No", onAnswer(No))
+	// 其他菜单KEY均视为"不知道"
+	m.OnEvent("CLICK", onAnswer(Pass))
+	m.Fallback(func(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
+		return TextReply{Content: "啥？"}, nil
+	})
+	return m
+}
+
+// 文本消息, "开始"开始新游戏, 其他文本转发给小冰
+func onText(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
 	var uid = header.FromUserName
-	bing, ok := sessions[uid]
-	if !ok {
-		if _bing, err := NewBing(); err != nil {
-			return MakeReply(header, TextReply{Content: "小冰崩溃了 :-("})
-		} else {
-			sessions[uid] = _bing
-			bing = _bing
-		}
+	var content = msg.(TextMessage).Content
+	if content == "开始" {
+		return TextReply{Content: startGame(ctx, uid)}, nil
 	}
-	// 交互
-	switch msg.(type) {
-	case TextMessage:
-		var content = msg.(TextMessage).Content
-		if content == "开始" {
-			if _bing, err := NewBing(); err != nil {
-				return MakeReply(header, TextReply{Content: "小冰崩溃了 :-("})
-			} else {
-				sessions[uid] = _bing
-				return MakeReply(header, TextReply{Content: _bing.send("开始")})
-			}
-		} else {
-			return MakeReply(header, TextReply{Content: bing.send(content)})
-		}
-	case SubscribeEvent:
-		return MakeReply(header, TextReply{Content: `我是小冰，想挑战我的【读心术】吗？
+	reply := play(ctx, uid, func(bing *Bing) (GameTurn, error) {
+		return bing.Send(ctx, content)
+	})
+	return TextReply{Content: reply}, nil
+}
+
+func onSubscribe(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
+	return TextReply{Content: `我是小冰，想挑战我的【读心术】吗？
 规则很简单。你在心里想好一个人的名字，然后按下【开始】。我将问你15个问题，之后，我就会轻松地猜到那个人是谁。
-我已经准备好了，开始吧？`})
-	case MenuClickEvent:
-		var answer int
-		switch msg.(MenuClickEvent).EventKey {
-		case "Start":
-			if _bing, err := NewBing(); err != nil {
-				return MakeReply(header, TextReply{Content: "小冰崩溃了 :-("})
-			} else {
-				sessions[uid] = _bing
-				return MakeReply(header, TextReply{Content: _bing.send("开始")})
+我已经准备好了，开始吧？`}, nil
+}
+
+// 用户已取消关注, 无需回复
+func onUnsubscribe(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
+	sessions.Delete(header.FromUserName)
+	return nil, nil
+}
+
+func onStart(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
+	return TextReply{Content: startGame(ctx, header.FromUserName)}, nil
+}
+
+// 回答游戏选项
+func onAnswer(answer int) HandlerFunc {
+	return func(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
+		reply := play(ctx, header.FromUserName, func(bing *Bing) (GameTurn, error) {
+			return bing.Next(ctx, answer)
+		})
+		return TextReply{Content: reply}, nil
+	}
+}
+
+// 在replyBudget内生成被动回复XML, 超时则返回nil, 回复生成后通过客服消息发送
+func respond(header *MessageHeader, msg Message) ([]byte, error) {
+	type result struct {
+		reply Reply
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// gin.Recovery不覆盖此goroutine, 处理消息时panic只影响本条消息
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("处理消息panic: %v\n%s\n", r, debug.Stack())
+				done <- result{err: fmt.Errorf("处理消息panic: %v", r)}
 			}
-		case "Yes":
-			answer = Yes
-		case "No":
-			answer = No
-		default:
-			answer = Pass
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+		defer cancel()
+		reply, err := mux.Handle(ctx, header, msg)
+		done <- result{reply, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil || r.reply == nil {
+			return nil, r.err
 		}
-		return MakeReply(header, TextReply{Content: bing.Next(answer)})
-	default:
-		return MakeReply(header, TextReply{Content: "啥？"})
+		return MakeReply(header, r.reply)
+	case <-time.After(replyBudget):
+		go func() {
+			r := <-done
+			if r.err != nil || r.reply == nil {
+				return
+			}
+			if err := client.SendCustomMessage(header.FromUserName, r.reply); err != nil {
+				log.Println(err)
+			}
+		}()
+		return nil, nil
 	}
 }
 
@@ -90,14 +231,49 @@ func checker(c *gin.Context) {
 }
 
 func main() {
+	// 子命令
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "simulate":
+			err = runSimulate(os.Args[2:])
+		case "play":
+			err = runPlay(os.Args[2:])
+		default:
+			log.Fatalf("未知的子命令: %s\n", os.Args[1])
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	var err error
+	if client, err = NewClient(config); err != nil {
+		log.Fatalln(err)
+	}
+	if config.EncodingAESKey != "" {
+		_crypt, err := NewMsgCrypt(config)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		crypt = &_crypt
+	}
 	router := gin.New()
+	router.Use(gin.Recovery())
 	// 开发者认证接口
 	router.GET("/wechat", checker, func(c *gin.Context) {
 		echostr := c.Query("echostr")
 		c.String(http.StatusOK, echostr)
 	})
+	// 提前刷新AccessToken, 避免用户请求时等待拉取
+	client.StartTokenRefresher(context.Background())
+	if tokenServerAddr != "" {
+		go func() {
+			log.Println("AccessToken服务监听:", tokenServerAddr)
+			log.Fatalln(http.ListenAndServe(tokenServerAddr, client.TokenServer(tokenServerSecret)))
+		}()
+	}
 	// 生成微信菜单
-	client := NewClient(config)
 	if err := client.SetMenu(menu); err != nil {
 		fmt.Println(err)
 	} else {
@@ -111,16 +287,47 @@ func main() {
 			c.String(http.StatusInternalServerError, "")
 			return
 		}
+		// 兼容模式和安全模式下, 微信在URL中附带encrypt_type=aes
+		encrypted := c.Query("encrypt_type") == "aes"
+		if encrypted {
+			if crypt == nil {
+				log.Println("收到加密消息, 但未配置EncodingAESKey")
+				c.String(http.StatusBadRequest, "")
+				return
+			}
+			body, err = crypt.Decrypt(&body, c.Query("timestamp"), c.Query("nonce"), c.Query("msg_signature"))
+			if err == ErrSignature || err == ErrReplay {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				c.String(http.StatusBadRequest, "")
+				return
+			}
+		}
 		header, message, err := Unmarshal(&body)
 		if err != nil {
 			c.String(http.StatusBadRequest, "")
 			return
 		}
-		resp, err := getResponse(header, message)
+		resp, err := replies.Do(header.DedupKey(), func() ([]byte, error) {
+			return respond(header, message)
+		})
 		if err != nil {
 			c.String(http.StatusOK, "")
 			return
 		}
+		// 无需回复或回复将通过客服消息发送
+		if resp == nil {
+			c.String(http.StatusOK, "success")
+			return
+		}
+		// 加密回复
+		if encrypted {
+			if resp, err = crypt.Encrypt(&resp); err != nil {
+				c.String(http.StatusOK, "")
+				return
+			}
+		}
 		c.Writer.WriteHeader(http.StatusOK)
 		c.Writer.Write(resp)
 	})
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/speng4096/bing/bingtest"
+)
+
+// 将小冰接口和会话存储替换为测试用的实例
+func useTestGame(t *testing.T, questions int) *bingtest.Server {
+	t.Helper()
+	srv := bingtest.NewServer(bingtest.Linear(questions, "周杰伦"))
+	oldOptions, oldSessions := bingOptions, sessions
+	bingOptions = testBingOptions(srv)
+	sessions = NewMemorySessionStore(time.Minute, 100)
+	t.Cleanup(func() {
+		bingOptions, sessions = oldOptions, oldSessions
+		srv.Close()
+	})
+	return srv
+}
+
+// 同一用户并发的多轮回答依次进行, 不互相覆盖
+func TestPlayConcurrent(t *testing.T) {
+	useTestGame(t, 15)
+	ctx := context.Background()
+	startGame(ctx, "u")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			play(ctx, "u", func(bing *Bing) (GameTurn, error) {
+				return bing.Next(ctx, Yes)
+			})
+		}()
+	}
+	wg.Wait()
+	bing, err := sessions.Get("u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := bing.State()
+	if state.Questions != 5 || len(state.History) != 5 {
+		t.Fatalf("4轮回答后应为第5题, 问答记录5轮: 第%d题, %d轮", state.Questions, len(state.History))
+	}
+}
+
+// 用户uid发来的消息, fields为MsgType及其后的字段
+func userXML(uid string, fields string) []byte {
+	return []byte(`<xml>
+<ToUserName><![CDATA[gh_123456]]></ToUserName>
+<FromUserName><![CDATA[` + uid + `]]></FromUserName>
+<CreateTime>1700000000</CreateTime>
+` + fields + `
+</xml>`)
+}
+
+// 经消息解码、路由、会话读写, 返回被动回复的文本
+func chat(t *testing.T, body []byte) string {
+	t.Helper()
+	header, msg, err := Unmarshal(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := respond(header, msg)
+	if err != nil || b == nil {
+		t.Fatalf("回复为%s, %v", b, err)
+	}
+	reply := struct {
+		ToUserName string
+		Content    string
+	}{}
+	if err := xml.Unmarshal(b, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ToUserName != header.FromUserName {
+		t.Fatalf("回复给%s, 应为%s", reply.ToUserName, header.FromUserName)
+	}
+	return reply.Content
+}
+
+// 发送"开始"后点击15次"是", 完成一局游戏
+func playGame(t *testing.T, uid string) {
+	t.Helper()
+	start := userXML(uid, `<MsgType><![CDATA[text]]></MsgType><Content><![CDATA[开始]]></Content><MsgId>1</MsgId>`)
+	yes := userXML(uid, `<MsgType><![CDATA[event]]></MsgType><Event><![CDATA[CLICK]]></Event><EventKey><![CDATA[Yes]]></EventKey>`)
+	if got := chat(t, start); !strings.HasPrefix(got, "第1题") {
+		t.Fatalf("%s: 开始后回复%q, 应为第1题", uid, got)
+	}
+	for i := 2; i <= 15; i++ {
+		if got := chat(t, yes); !strings.HasPrefix(got, fmt.Sprintf("第%d题", i)) {
+			t.Fatalf("%s: 回复%q, 应为第%d题", uid, got, i)
+		}
+	}
+	if got := chat(t, yes); !strings.Contains(got, "周杰伦") {
+		t.Fatalf("%s: 15题后回复%q, 应猜出周杰伦", uid, got)
+	}
+	bing, err := sessions.Get(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(bing.State().History); n != 16 {
+		t.Fatalf("%s: 问答记录为%d轮, 应为16轮", uid, n)
+	}
+}
+
+func TestGame(t *testing.T) {
+	srv := useTestGame(t, 15)
+	playGame(t, "oUser")
+	// 同一会话的请求使用同一senderID
+	var senderID string
+	for _, call := range srv.Calls() {
+		if call.SenderID == "" {
+			continue
+		}
+		if senderID == "" {
+			senderID = call.SenderID
+		}
+		if call.SenderID != senderID {
+			t.Fatalf("会话的senderID从%s变为%s", senderID, call.SenderID)
+		}
+	}
+}
+
+// 多个用户同时游戏, 会话互不影响
+func TestGameConcurrentUsers(t *testing.T) {
+	useTestGame(t, 15)
+	t.Run("users", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			uid := fmt.Sprintf("oUser%d", i)
+			t.Run(uid, func(t *testing.T) {
+				t.Parallel()
+				playGame(t, uid)
+			})
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// 菜单按钮类型
+const (
+	ButtonClick           = "click"              // 点击推事件
+	ButtonView            = "view"               // 跳转URL
+	ButtonScanCodePush    = "scancode_push"      // 扫码推事件
+	ButtonScanCodeWaitMsg = "scancode_waitmsg"   // 扫码推事件且弹出"消息接收中"提示框
+	ButtonPicSysPhoto     = "pic_sysphoto"       // 弹出系统拍照发图
+	ButtonPicPhotoOrAlbum = "pic_photo_or_album" // 弹出拍照或者相册发图
+	ButtonPicWeixin       = "pic_weixin"         // 弹出微信相册发图器
+	ButtonLocationSelect  = "location_select"    // 弹出地理位置选择器
+	ButtonMediaID         = "media_id"           // 下发永久素材消息
+	ButtonViewLimited     = "view_limited"       // 跳转永久图文消息URL
+	ButtonMiniprogram     = "miniprogram"        // 跳转小程序
+)
+
+// 微信对菜单的限制
+const (
+	maxButtons    = 3    // 一级菜单数
+	maxSubButtons = 5    // 二级菜单数
+	maxNameLen    = 16   // 一级菜单标题字节数
+	maxSubNameLen = 60   // 二级菜单标题字节数
+	maxKeyLen     = 128  // KEY字节数
+	maxURLLen     = 1024 // URL字节数
+)
+
+// 自定义菜单, MatchRule不为nil时为个性化菜单
+type Menu struct {
+	Buttons   []Button   `json:"button"`
+	MatchRule *MatchRule `json:"matchrule,omitempty"`
+	MenuID    IntString  `json:"menuid,omitempty"` // 查询菜单时返回
+}
+
+// 以字符串保存的数字字段, 微信在不同接口中返回数字或字符串, 两者均可解析, 序列化为字符串
+type IntString string
+
+func (s *IntString) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		var v string
+		if err := json.Unmarshal(b, &v); err != nil {
+			return err
+		}
+		*s = IntString(v)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("应为数字或字符串: %s", b)
+	}
+	*s = IntString(n)
+	return nil
+}
+
+// 菜单按钮, SubButtons不为空时为二级菜单, 此时Type等字段无效
+type Button struct {
+	Type       string   `json:"type,omitempty"`
+	Name       string   `json:"name"`
+	Key        string   `json:"key,omitempty"`
+	URL        string   `json:"url,omitempty"`
+	MediaID    string   `json:"media_id,omitempty"`
+	AppID      string   `json:"appid,omitempty"`
+	PagePath   string   `json:"pagepath,omitempty"`
+	SubButtons []Button `json:"sub_button,omitempty"`
+}
+
+// 个性化菜单匹配规则, 字段均为空时匹配所有用户
+type MatchRule struct {
+	TagID              IntString `json:"tag_id,omitempty"`
+	Sex                IntString `json:"sex,omitempty"` // 1男 2女
+	Country            string    `json:"country,omitempty"`
+	Province           string    `json:"province,omitempty"`
+	City               string    `json:"city,omitempty"`
+	ClientPlatformType IntString `json:"client_platform_type,omitempty"` // 1 IOS 2 Android 3 Others
+	Language           string    `json:"language,omitempty"`
+}
+
+// 查询到的全部菜单
+type MenuInfo struct {
+	Menu            Menu   `json:"menu"`
+	ConditionalMenu []Menu `json:"conditionalmenu"`
+}
+
+// 通过API或公众平台官网设置的当前菜单
+type SelfMenuInfo struct {
+	IsMenuOpen int `json:"is_menu_open"`
+	Info       struct {
+		Buttons []SelfMenuButton `json:"button"`
+	} `json:"selfmenu_info"`
+}
+
+type SelfMenuButton struct {
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+	URL       string `json:"url"`
+	Value     string `json:"value"`
+	SubButton struct {
+		List []SelfMenuButton `json:"list"`
+	} `json:"sub_button"`
+}
+
+// 构造菜单按钮
+func ClickButton(name string, key string) Button {
+	return Button{Type: ButtonClick, Name: name, Key: key}
+}
+
+func ViewButton(name string, url string) Button {
+	return Button{Type: ButtonView, Name: name, URL: url}
+}
+
+func ScanCodePushButton(name string, key string) Button {
+	return Button{Type: ButtonScanCodePush, Name: name, Key: key}
+}
+
+func ScanCodeWaitMsgButton(name string, key string) Button {
+	return Button{Type: ButtonScanCodeWaitMsg, Name: name, Key: key}
+}
+
+func PicSysPhotoButton(name string, key string) Button {
+	return Button{Type: ButtonPicSysPhoto, Name: name, Key: key}
+}
+
+func PicPhotoOrAlbumButton(name string, key string) Button {
+	return Button{Type: ButtonPicPhotoOrAlbum, Name: name, Key: key}
+}
+
+func PicWeixinButton(name string, key string) Button {
+	return Button{Type: ButtonPicWeixin, Name: name, Key: key}
+}
+
+func LocationSelectButton(name string, key string) Button {
+	return Button{Type: ButtonLocationSelect, Name: name, Key: key}
+}
+
+func MediaIDButton(name string, mediaID string) Button {
+	return Button{Type: ButtonMediaID, Name: name, MediaID: mediaID}
+}
+
+func ViewLimitedButton(name string, mediaID string) Button {
+	return Button{Type: ButtonViewLimited, Name: name, MediaID: mediaID}
+}
+
+// url为不支持小程序的老版本客户端打开的网页
+func MiniprogramButton(name string, url string, appID string, pagePath string) Button {
+	return Button{Type: ButtonMiniprogram, Name: name, URL: url, AppID: appID, PagePath: pagePath}
+}
+
+// 二级菜单
+func SubMenu(name string, buttons ...Button) Button {
+	return Button{Name: name, SubButtons: buttons}
+}
+
+// 按微信的限制检查菜单
+func (m Menu) Validate() error {
+	if len(m.Buttons) == 0 || len(m.Buttons) > maxButtons {
+		return fmt.Errorf("一级菜单数应为1~%d个, 当前为%d个", maxButtons, len(m.Buttons))
+	}
+	for _, b := range m.Buttons {
+		if len(b.Name) == 0 || len(b.Name) > maxNameLen {
+			return fmt.Errorf("一级菜单[%s]标题应为1~%d个字节", b.Name, maxNameLen)
+		}
+		if b.SubButtons == nil {
+			if err := b.validate(); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(b.SubButtons) == 0 || len(b.SubButtons) > maxSubButtons {
+			return fmt.Errorf("菜单[%s]的二级菜单数应为1~%d个, 当前为%d个", b.Name, maxSubButtons, len(b.SubButtons))
+		}
+		for _, sub := range b.SubButtons {
+			if len(sub.Name) == 0 || len(sub.Name) > maxSubNameLen {
+				return fmt.Errorf("二级菜单[%s]标题应为1~%d个字节", sub.Name, maxSubNameLen)
+			}
+			if sub.SubButtons != nil {
+				return fmt.Errorf("二级菜单[%s]不能再包含子菜单", sub.Name)
+			}
+			if err := sub.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 检查按钮类型及其必填字段
+func (b Button) validate() error {
+	switch b.Type {
+	case ButtonClick, ButtonScanCodePush, ButtonScanCodeWaitMsg,
+		ButtonPicSysPhoto, ButtonPicPhotoOrAlbum, ButtonPicWeixin, ButtonLocationSelect:
+		if len(b.Key) == 0 || len(b.Key) > maxKeyLen {
+			return fmt.Errorf("菜单[%s]的key应为1~%d个字节", b.Name, maxKeyLen)
+		}
+	case ButtonView:
+		if len(b.URL) == 0 || len(b.URL) > maxURLLen {
+			return fmt.Errorf("菜单[%s]的url应为1~%d个字节", b.Name, maxURLLen)
+		}
+	case ButtonMediaID, ButtonViewLimited:
+		if b.MediaID == "" {
+			return fmt.Errorf("菜单[%s]缺少media_id", b.Name)
+		}
+	case ButtonMiniprogram:
+		if b.URL == "" || b.AppID == "" || b.PagePath == "" {
+			return fmt.Errorf("菜单[%s]缺少url, appid或pagepath", b.Name)
+		}
+	default:
+		return fmt.Errorf("菜单[%s]的类型错误: %s", b.Name, b.Type)
+	}
+	return nil
+}
+
+// 创建自定义菜单
+func (c Client) SetMenu(menu Menu) error {
+	if err := menu.Validate(); err != nil {
+		return err
+	}
+	menu.MatchRule = nil
+	menu.MenuID = ""
+	if err := c.postJSON("/menu/create", menu, nil); err != nil {
+		return fmt.Errorf("创建菜单失败: %w", err)
+	}
+	return nil
+}
+
+// 查询自定义菜单, 包含个性化菜单
+func (c Client) GetMenu() (MenuInfo, error) {
+	info := MenuInfo{}
+	err := c.getJSON("/menu/get", &info)
+	return info, err
+}
+
+// 删除自定义菜单, 同时删除全部个性化菜单
+func (c Client) DeleteMenu() error {
+	return c.getJSON("/menu/delete", nil)
+}
+
+// 查询当前使用的菜单, 包含在公众平台官网设置的菜单
+func (c Client) GetCurrentSelfMenuInfo() (SelfMenuInfo, error) {
+	info := SelfMenuInfo{}
+	err := c.getJSON("/get_current_selfmenu_info", &info)
+	return info, err
+}
+
+// 创建个性化菜单, 返回menuid
+func (c Client) AddConditionalMenu(menu Menu) (string, error) {
+	if menu.MatchRule == nil {
+		return "", fmt.Errorf("个性化菜单缺少matchrule")
+	}
+	if err := menu.Validate(); err != nil {
+		return "", err
+	}
+	menu.MenuID = ""
+	j := struct {
+		MenuID IntString `json:"menuid"`
+	}{}
+	if err := c.postJSON("/menu/addconditional", menu, &j); err != nil {
+		return "", fmt.Errorf("创建个性化菜单失败: %w", err)
+	}
+	return string(j.MenuID), nil
+}
+
+// 删除个性化菜单
+func (c Client) DeleteConditionalMenu(menuID string) error {
+	return c.postJSON("/menu/delconditional", map[string]string{"menuid": menuID}, nil)
+}
+
+// 测试个性化菜单匹配结果, userID可以是OpenID或微信号
+func (c Client) TryMatchMenu(userID string) (Menu, error) {
+	menu := Menu{}
+	err := c.postJSON("/menu/trymatch", map[string]string{"user_id": userID}, &menu)
+	return menu, err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMenuValidate(t *testing.T) {
+	click := ClickButton("是", "Yes")
+	tests := []struct {
+		name string
+		menu Menu
+		ok   bool
+	}{
+		{"默认菜单", menu, true},
+		{"0个一级菜单", Menu{}, false},
+		{"3个一级菜单", Menu{Buttons: []Button{click, click, click}}, true},
+		{"4个一级菜单", Menu{Buttons: []Button{click, click, click, click}}, false},
+		{"5个二级菜单", Menu{Buttons: []Button{SubMenu("回答", click, click, click, click, click)}}, true},
+		{"6个二级菜单", Menu{Buttons: []Button{SubMenu("回答", click, click, click, click, click, click)}}, false},
+		{"空的二级菜单", Menu{Buttons: []Button{SubMenu("回答")}}, false},
+		{"16字节一级标题", Menu{Buttons: []Button{ClickButton(strings.Repeat("a", 16), "k")}}, true},
+		{"17字节一级标题", Menu{Buttons: []Button{ClickButton(strings.Repeat("a", 17), "k")}}, false},
+		{"6个汉字一级标题", Menu{Buttons: []Button{ClickButton("开始新的游戏", "k")}}, false},
+		{"60字节二级标题", Menu{Buttons: []Button{SubMenu("回答", ClickButton(strings.Repeat("a", 60), "k"))}}, true},
+		{"61字节二级标题", Menu{Buttons: []Button{SubMenu("回答", ClickButton(strings.Repeat("a", 61), "k"))}}, false},
+		{"空标题", Menu{Buttons: []Button{ClickButton("", "k")}}, false},
+		{"缺少key", Menu{Buttons: []Button{ClickButton("开始", "")}}, false},
+		{"129字节key", Menu{Buttons: []Button{ClickButton("开始", strings.Repeat("k", 129))}}, false},
+		{"缺少url", Menu{Buttons: []Button{ViewButton("主页", "")}}, false},
+		{"跳转URL", Menu{Buttons: []Button{ViewButton("主页", "http://example.com")}}, true},
+		{"缺少media_id", Menu{Buttons: []Button{MediaIDButton("图片", "")}}, false},
+		{"缺少appid", Menu{Buttons: []Button{MiniprogramButton("小程序", "http://example.com", "", "pages/index")}}, false},
+		{"小程序", Menu{Buttons: []Button{MiniprogramButton("小程序", "http://example.com", "wx123", "pages/index")}}, true},
+		{"未知类型", Menu{Buttons: []Button{{Type: "unknown", Name: "开始", Key: "k"}}}, false},
+		{"缺少类型", Menu{Buttons: []Button{{Name: "开始", Key: "k"}}}, false},
+		{"嵌套子菜单", Menu{Buttons: []Button{SubMenu("回答", SubMenu("更多", click))}}, false},
+	}
+	for _, tt := range tests {
+		err := tt.menu.Validate()
+		if tt.ok && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: 应返回error", tt.name)
+		}
+	}
+}
+
+func TestIntString(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want IntString
+	}{
+		{`{"menuid":208379533}`, "208379533"},
+		{`{"menuid":"208379533"}`, "208379533"},
+		{`{"menuid":null}`, ""},
+		{`{}`, ""},
+	}
+	for _, tt := range tests {
+		var m Menu
+		if err := json.Unmarshal([]byte(tt.raw), &m); err != nil {
+			t.Fatalf("%s: %s", tt.raw, err)
+		}
+		if m.MenuID != tt.want {
+			t.Errorf("%s: MenuID为%q, 应为%q", tt.raw, m.MenuID, tt.want)
+		}
+	}
+	var m Menu
+	if err := json.Unmarshal([]byte(`{"menuid":true}`), &m); err == nil {
+		t.Fatal("menuid为布尔值时应返回error")
+	}
+	// 提交时序列化为字符串
+	b, _ := json.Marshal(MatchRule{Sex: "1"})
+	if string(b) != `{"sex":"1"}` {
+		t.Fatalf("序列化为%s", b)
+	}
+}
+
+func TestClientConditionalMenu(t *testing.T) {
+	client, _ := newTestClient(t)
+	if err := client.SetMenu(menu); err != nil {
+		t.Fatal(err)
+	}
+	conditional := menu
+	conditional.MatchRule = &MatchRule{Sex: "2", ClientPlatformType: "1"}
+	menuID, err := client.AddConditionalMenu(conditional)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 查询时menuid和匹配规则中的数字字段以数字返回
+	info, err := client.GetMenu()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.ConditionalMenu) != 1 {
+		t.Fatalf("查询到%d个个性化菜单, 应为1个", len(info.ConditionalMenu))
+	}
+	got := info.ConditionalMenu[0]
+	if string(got.MenuID) != menuID {
+		t.Fatalf("menuid为%q, 应为%q", got.MenuID, menuID)
+	}
+	if got.MatchRule == nil || got.MatchRule.Sex != "2" || got.MatchRule.ClientPlatformType != "1" {
+		t.Fatalf("匹配规则错误: %+v", got.MatchRule)
+	}
+	if err := client.DeleteConditionalMenu(string(got.MenuID)); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := client.GetMenu(); len(info.ConditionalMenu) != 0 {
+		t.Fatal("个性化菜单未删除")
+	}
+}
@@ -4,7 +4,8 @@ package main
 import (
 	"encoding/xml"
 	"fmt"
-	"regexp"
+	"reflect"
+	"strconv"
 )
 
 // Message表示所有消息类型, 包含普通消息(XXXMessage)和事件消息(XXXEvent)
@@ -25,11 +26,23 @@ var (
 	_ Message = LocationEvent{}
 	_ Message = MenuClickEvent{}
 	_ Message = MenuViewEvent{}
+	_ Message = MenuScanCodePushEvent{}
+	_ Message = MenuScanCodeWaitMsgEvent{}
+	_ Message = MenuPicSysPhotoEvent{}
+	_ Message = MenuPicPhotoOrAlbumEvent{}
+	_ Message = MenuPicWeixinEvent{}
+	_ Message = MenuLocationSelectEvent{}
+	_ Message = MenuViewMiniprogramEvent{}
+	_ Message = TemplateSendJobFinishEvent{}
+	_ Message = MassSendJobFinishEvent{}
+	_ Message = UnknownEvent{}
 )
-var (
-	reEvent = regexp.MustCompile(`<Event><!\[CDATA\[(\w+)]]></Event>`)
-	reType  = regexp.MustCompile(`<MsgType><!\[CDATA\[(\w+)]]></MsgType>`)
-)
+
+// 用于识别消息类型的信封, 首次解码只读取MsgType和Event
+type envelope struct {
+	MsgType string `xml:"MsgType"`
+	Event   string `xml:"Event"`
+}
 
 // Message共有成员，可用于构造Reply
 type MessageHeader struct {
@@ -42,6 +55,14 @@ type MessageHeader struct {
 	MsgID string `xml:"MsgId"`
 }
 
+// 消息排重key, 普通消息为MsgId, 事件消息为FromUserName+CreateTime(十进制)
+func (h MessageHeader) DedupKey() string {
+	if h.MsgType == "event" {
+		return h.FromUserName + strconv.FormatInt(int64(h.CreateTime), 10)
+	}
+	return h.MsgID
+}
+
 // 加密消息
 type EncryptMessage struct {
 	ToUserName string
@@ -94,9 +115,9 @@ type LocationMessage struct {
 // 链接消息
 type LinkMessage struct {
 	MessageHeader
-	Title       float32 `xml:"Title"`
-	Description float32 `xml:"Description"`
-	Url         int32   `xml:"Url"`
+	Title       string `xml:"Title"`
+	Description string `xml:"Description"`
+	Url         string `xml:"Url"`
 }
 
 // 关注事件
@@ -146,102 +167,197 @@ type MenuViewEvent struct {
 	EventKey string `xml:"EventKey"` // 事件KEY值，设置的跳转URL
 }
 
-func unmarshalMessage(msgType string, xmlBytes *[]byte) (*MessageHeader, Message, error) {
+// 扫码信息
+type ScanCodeInfo struct {
+	ScanType   string `xml:"ScanType"`   // 扫描类型, 一般是qrcode
+	ScanResult string `xml:"ScanResult"` // 扫描结果, 即二维码对应的字符串信息
+}
+
+// 发送的图片信息
+type SendPicsInfo struct {
+	Count   int32    `xml:"Count"`                  // 发送的图片数量
+	PicList []string `xml:"PicList>item>PicMd5Sum"` // 图片的MD5值
+}
+
+// 发送的位置信息
+type SendLocationInfo struct {
+	X       float32 `xml:"Location_X"` // 纬度
+	Y       float32 `xml:"Location_Y"` // 经度
+	Scale   int32   `xml:"Scale"`      // 精度
+	Label   string  `xml:"Label"`      // 地理位置信息
+	Poiname string  `xml:"Poiname"`    // 朋友圈POI的名字
+}
+
+// 扫码推事件
+type MenuScanCodePushEvent struct {
+	MessageHeader
+	Event        string       `xml:"Event"`    // scancode_push
+	EventKey     string       `xml:"EventKey"` // 事件KEY值，与自定义菜单接口中KEY值对应
+	ScanCodeInfo ScanCodeInfo `xml:"ScanCodeInfo"`
+}
+
+// 扫码推事件且弹出"消息接收中"提示框
+type MenuScanCodeWaitMsgEvent struct {
+	MessageHeader
+	Event        string       `xml:"Event"`    // scancode_waitmsg
+	EventKey     string       `xml:"EventKey"` // 事件KEY值，与自定义菜单接口中KEY值对应
+	ScanCodeInfo ScanCodeInfo `xml:"ScanCodeInfo"`
+}
+
+// 弹出系统拍照发图
+type MenuPicSysPhotoEvent struct {
+	MessageHeader
+	Event        string       `xml:"Event"`    // pic_sysphoto
+	EventKey     string       `xml:"EventKey"` // 事件KEY值，与自定义菜单接口中KEY值对应
+	SendPicsInfo SendPicsInfo `xml:"SendPicsInfo"`
+}
+
+// 弹出拍照或者相册发图
+type MenuPicPhotoOrAlbumEvent struct {
+	MessageHeader
+	Event        string       `xml:"Event"`    // pic_photo_or_album
+	EventKey     string       `xml:"EventKey"` // 事件KEY值，与自定义菜单接口中KEY值对应
+	SendPicsInfo SendPicsInfo `xml:"SendPicsInfo"`
+}
+
+// 弹出微信相册发图器
+type MenuPicWeixinEvent struct {
+	MessageHeader
+	Event        string       `xml:"Event"`    // pic_weixin
+	EventKey     string       `xml:"EventKey"` // 事件KEY值，与自定义菜单接口中KEY值对应
+	SendPicsInfo SendPicsInfo `xml:"SendPicsInfo"`
+}
+
+// 弹出地理位置选择器
+type MenuLocationSelectEvent struct {
+	MessageHeader
+	Event            string           `xml:"Event"`    // location_select
+	EventKey         string           `xml:"EventKey"` // 事件KEY值，与自定义菜单接口中KEY值对应
+	SendLocationInfo SendLocationInfo `xml:"SendLocationInfo"`
+}
+
+// 点击菜单跳转小程序
+type MenuViewMiniprogramEvent struct {
+	MessageHeader
+	Event    string `xml:"Event"`    // view_miniprogram
+	EventKey string `xml:"EventKey"` // 跳转的小程序路径
+	MenuID   string `xml:"MenuId"`   // 菜单ID, 个性化菜单时可用于区分菜单
+}
+
+// 模板消息发送任务完成
+type TemplateSendJobFinishEvent struct {
+	MessageHeader
+	Event  string `xml:"Event"`  // TEMPLATESENDJOBFINISH
+	JobID  int64  `xml:"MsgID"`  // 模板消息ID
+	Status string `xml:"Status"` // 发送状态, 如success, failed:user block, failed: system failed
+}
+
+// 群发任务完成
+type MassSendJobFinishEvent struct {
+	MessageHeader
+	Event       string `xml:"Event"`       // MASSSENDJOBFINISH
+	JobID       int64  `xml:"MsgID"`       // 群发消息ID
+	Status      string `xml:"Status"`      // 群发结果, 如send success, send fail, err(num)
+	TotalCount  int32  `xml:"TotalCount"`  // 粉丝数
+	FilterCount int32  `xml:"FilterCount"` // 过滤后准备发送的粉丝数
+	SentCount   int32  `xml:"SentCount"`   // 发送成功的粉丝数
+	ErrorCount  int32  `xml:"ErrorCount"`  // 发送失败的粉丝数
+}
+
+// 未支持的事件, Raw为原始XML
+type UnknownEvent struct {
+	MessageHeader
+	Event string `xml:"Event"`
+	Raw   []byte `xml:"-"`
+}
+
+// 创建用于解码普通消息的指针
+func newMessage(msgType string) (Message, error) {
 	switch msgType {
 	case "text":
-		msg := TextMessage{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		return header, msg, err
+		return &TextMessage{}, nil
 	case "image":
-		msg := ImageMessage{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		return header, msg, err
+		return &ImageMessage{}, nil
 	case "voice":
-		msg := VoiceMessage{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		return header, msg, err
+		return &VoiceMessage{}, nil
 	case "video":
-		msg := VideoMessage{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		return header, msg, err
+		return &VideoMessage{}, nil
 	case "shortvideo":
-		msg := ShortVideoMessage{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		return header, msg, err
+		return &ShortVideoMessage{}, nil
 	case "location":
-		msg := LocationMessage{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		return header, msg, err
+		return &LocationMessage{}, nil
 	case "link":
-		msg := LinkMessage{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		return header, msg, err
+		return &LinkMessage{}, nil
 	default:
-		return nil, nil, fmt.Errorf("错误的消息类型: %s", msgType)
+		return nil, fmt.Errorf("错误的消息类型: %s", msgType)
 	}
 }
 
-func unmarshalEvent(msgEvent string, xmlBytes *[]byte) (*MessageHeader, Message, error) {
+// 创建用于解码事件消息的指针, 未支持的事件返回UnknownEvent
+func newEvent(msgEvent string, xmlBytes []byte) Message {
 	switch msgEvent {
 	case "subscribe":
-		msg := SubscribeEvent{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		header.MsgID = header.FromUserName + string(header.CreateTime)
-		return header, msg, err
+		return &SubscribeEvent{}
 	case "unsubscribe":
-		msg := UnSubscribeEvent{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		header.MsgID = header.FromUserName + string(header.CreateTime)
-		return header, msg, err
+		return &UnSubscribeEvent{}
 	case "SCAN":
-		msg := ScanEvent{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		header.MsgID = header.FromUserName + string(header.CreateTime)
-		return header, msg, err
+		return &ScanEvent{}
 	case "LOCATION":
-		msg := LocationEvent{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		header.MsgID = header.FromUserName + string(header.CreateTime)
-		return header, msg, err
+		return &LocationEvent{}
 	case "CLICK":
-		msg := MenuClickEvent{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		header.MsgID = header.FromUserName + string(header.CreateTime)
-		return header, msg, err
+		return &MenuClickEvent{}
 	case "VIEW":
-		msg := MenuViewEvent{}
-		err := xml.Unmarshal(*xmlBytes, &msg)
-		header := &msg.MessageHeader
-		header.MsgID = header.FromUserName + string(header.CreateTime)
-		return header, msg, err
+		return &MenuViewEvent{}
+	case "scancode_push":
+		return &MenuScanCodePushEvent{}
+	case "scancode_waitmsg":
+		return &MenuScanCodeWaitMsgEvent{}
+	case "pic_sysphoto":
+		return &MenuPicSysPhotoEvent{}
+	case "pic_photo_or_album":
+		return &MenuPicPhotoOrAlbumEvent{}
+	case "pic_weixin":
+		return &MenuPicWeixinEvent{}
+	case "location_select":
+		return &MenuLocationSelectEvent{}
+	case "view_miniprogram":
+		return &MenuViewMiniprogramEvent{}
+	case "TEMPLATESENDJOBFINISH":
+		return &TemplateSendJobFinishEvent{}
+	case "MASSSENDJOBFINISH":
+		return &MassSendJobFinishEvent{}
 	default:
-		return nil, nil, fmt.Errorf("错误的事件类型: %s", msgEvent)
+		return &UnknownEvent{Raw: append([]byte(nil), xmlBytes...)}
 	}
 }
 
 // 反序列化微信消息为struct
 func Unmarshal(body *[]byte) (*MessageHeader, Message, error) {
-	items := reType.FindSubmatch(*body)
-	if len(items) == 0 {
+	env := envelope{}
+	if err := xml.Unmarshal(*body, &env); err != nil {
+		return nil, nil, fmt.Errorf("微信消息格式错误: %s", err)
+	}
+	var ptr Message
+	switch env.MsgType {
+	case "":
 		return nil, nil, fmt.Errorf("微信消息格式错误, 未找到MsgType字段")
+	case "event":
+		if env.Event == "" {
+			return nil, nil, fmt.Errorf("微信消息格式错误, 未找到Event字段")
+		}
+		ptr = newEvent(env.Event, *body)
+	default:
+		var err error
+		if ptr, err = newMessage(env.MsgType); err != nil {
+			return nil, nil, err
+		}
 	}
-	if msgType := string(items[1]); msgType == "event" {
-		eventItems := reEvent.FindSubmatch(*body)
-		event := string(eventItems[1])
-		return unmarshalEvent(event, body)
-	} else {
-		return unmarshalMessage(msgType, body)
+	if err := xml.Unmarshal(*body, ptr); err != nil {
+		return nil, nil, fmt.Errorf("微信消息格式错误: %s", err)
 	}
+	v := reflect.ValueOf(ptr).Elem()
+	header := v.FieldByName("MessageHeader").Addr().Interface().(*MessageHeader)
+	// 事件消息没有MsgId, 以DedupKey填充, 须在复制出消息值之前设置
+	header.MsgID = header.DedupKey()
+	return header, v.Interface(), nil
 }
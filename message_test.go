@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// 构造事件消息XML
+func eventXML(event string, fields string) []byte {
+	return []byte(`<xml>
+<ToUserName><![CDATA[gh_123456]]></ToUserName>
+<FromUserName><![CDATA[oUser]]></FromUserName>
+<CreateTime>1700000000</CreateTime>
+<MsgType><![CDATA[event]]></MsgType>
+<Event><![CDATA[` + event + `]]></Event>
+` + fields + `
+</xml>`)
+}
+
+func TestUnmarshalEvent(t *testing.T) {
+	tests := []struct {
+		event  string
+		fields string
+		want   Message
+	}{
+		{"subscribe", `<EventKey><![CDATA[qrscene_123]]></EventKey><Ticket><![CDATA[TICKET]]></Ticket>`, SubscribeEvent{}},
+		{"unsubscribe", ``, UnSubscribeEvent{}},
+		{"SCAN", `<EventKey><![CDATA[123]]></EventKey><Ticket><![CDATA[TICKET]]></Ticket>`, ScanEvent{}},
+		{"LOCATION", `<Latitude>23.137466</Latitude><Longitude>113.352425</Longitude><Precision>119.385040</Precision>`, LocationEvent{}},
+		{"CLICK", `<EventKey><![CDATA[Start]]></EventKey>`, MenuClickEvent{}},
+		{"VIEW", `<EventKey><![CDATA[https://example.com/]]></EventKey>`, MenuViewEvent{}},
+		{"scancode_push", `<EventKey><![CDATA[scan]]></EventKey><ScanCodeInfo><ScanType><![CDATA[qrcode]]></ScanType><ScanResult><![CDATA[1]]></ScanResult></ScanCodeInfo>`, MenuScanCodePushEvent{}},
+		{"scancode_waitmsg", `<EventKey><![CDATA[scan]]></EventKey><ScanCodeInfo><ScanType><![CDATA[qrcode]]></ScanType><ScanResult><![CDATA[2]]></ScanResult></ScanCodeInfo>`, MenuScanCodeWaitMsgEvent{}},
+		{"pic_sysphoto", `<EventKey><![CDATA[pic]]></EventKey><SendPicsInfo><Count>1</Count><PicList><item><PicMd5Sum><![CDATA[1b5f7c23b5bf75682a53e7b6d163e185]]></PicMd5Sum></item></PicList></SendPicsInfo>`, MenuPicSysPhotoEvent{}},
+		{"pic_photo_or_album", `<EventKey><![CDATA[pic]]></EventKey><SendPicsInfo><Count>1</Count><PicList><item><PicMd5Sum><![CDATA[5a75aaca956d97be686719218f275c6b]]></PicMd5Sum></item></PicList></SendPicsInfo>`, MenuPicPhotoOrAlbumEvent{}},
+		{"pic_weixin", `<EventKey><![CDATA[pic]]></EventKey><SendPicsInfo><Count>1</Count><PicList><item><PicMd5Sum><![CDATA[5a75aaca956d97be686719218f275c6b]]></PicMd5Sum></item></PicList></SendPicsInfo>`, MenuPicWeixinEvent{}},
+		{"location_select", `<EventKey><![CDATA[loc]]></EventKey><SendLocationInfo><Location_X><![CDATA[23]]></Location_X><Location_Y><![CDATA[113]]></Location_Y><Scale><![CDATA[15]]></Scale><Label><![CDATA[广州市]]></Label><Poiname><![CDATA[]]></Poiname></SendLocationInfo>`, MenuLocationSelectEvent{}},
+		{"view_miniprogram", `<EventKey><![CDATA[pages/index/index]]></EventKey><MenuId>MENUID</MenuId>`, MenuViewMiniprogramEvent{}},
+		{"TEMPLATESENDJOBFINISH", `<MsgID>200163836</MsgID><Status><![CDATA[success]]></Status>`, TemplateSendJobFinishEvent{}},
+		{"MASSSENDJOBFINISH", `<MsgID>1000001625</MsgID><Status><![CDATA[send success]]></Status><TotalCount>100</TotalCount><FilterCount>80</FilterCount><SentCount>75</SentCount><ErrorCount>5</ErrorCount>`, MassSendJobFinishEvent{}},
+		{"user_get_card", `<CardId><![CDATA[pFS7Fjg8kV1IdDz01r4SQwMkuCKc]]></CardId>`, UnknownEvent{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			body := eventXML(tt.event, tt.fields)
+			header, msg, err := Unmarshal(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.TypeOf(msg) != reflect.TypeOf(tt.want) {
+				t.Fatalf("消息类型为%T, 应为%T", msg, tt.want)
+			}
+			if got := eventName(msg); got != tt.event {
+				t.Errorf("Event为%q, 应为%q", got, tt.event)
+			}
+			// 事件消息以FromUserName+十进制CreateTime排重
+			const key = "oUser1700000000"
+			if got := header.DedupKey(); got != key {
+				t.Errorf("DedupKey()为%q, 应为%q", got, key)
+			}
+			if header.MsgID != key {
+				t.Errorf("header.MsgID为%q, 应为%q", header.MsgID, key)
+			}
+			embedded := reflect.ValueOf(msg).FieldByName("MessageHeader").Interface().(MessageHeader)
+			if embedded.MsgID != key {
+				t.Errorf("消息中的MsgID为%q, 应为%q", embedded.MsgID, key)
+			}
+		})
+	}
+}
+
+func TestUnmarshalEventFields(t *testing.T) {
+	body := eventXML("MASSSENDJOBFINISH", `<MsgID>1000001625</MsgID><Status><![CDATA[send success]]></Status><SentCount>75</SentCount>`)
+	_, msg, err := Unmarshal(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 群发任务ID不能覆盖排重用的MsgID
+	event := msg.(MassSendJobFinishEvent)
+	if event.JobID != 1000001625 || event.SentCount != 75 || event.MsgID != "oUser1700000000" {
+		t.Fatalf("解码结果错误: %+v", event)
+	}
+
+	body = eventXML("location_select", `<SendLocationInfo><Location_X>23</Location_X><Label><![CDATA[广州市]]></Label></SendLocationInfo>`)
+	_, msg, err = Unmarshal(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := msg.(MenuLocationSelectEvent).SendLocationInfo; info.X != 23 || info.Label != "广州市" {
+		t.Fatalf("解码结果错误: %+v", info)
+	}
+}
+
+func TestUnmarshalMessageDedupKey(t *testing.T) {
+	body := []byte(`<xml>
+<ToUserName><![CDATA[gh_123456]]></ToUserName>
+<FromUserName><![CDATA[oUser]]></FromUserName>
+<CreateTime>1700000000</CreateTime>
+<MsgType><![CDATA[text]]></MsgType>
+<Content><![CDATA[开始]]></Content>
+<MsgId>23456789012345678</MsgId>
+</xml>`)
+	header, msg, err := Unmarshal(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(TextMessage); !ok {
+		t.Fatalf("消息类型为%T, 应为TextMessage", msg)
+	}
+	if got := header.DedupKey(); got != "23456789012345678" {
+		t.Fatalf("DedupKey()为%q, 应为MsgId", got)
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	tests := map[string]string{
+		"缺少Event":   `<xml><FromUserName>oUser</FromUserName><CreateTime>1700000000</CreateTime><MsgType>event</MsgType></xml>`,
+		"缺少MsgType": `<xml><FromUserName>oUser</FromUserName><CreateTime>1700000000</CreateTime></xml>`,
+		"未知消息类型":    `<xml><MsgType>unknown</MsgType></xml>`,
+		"非XML":      `{"MsgType":"text"}`,
+	}
+	for name, s := range tests {
+		body := []byte(s)
+		if _, _, err := Unmarshal(&body); err == nil {
+			t.Errorf("%s: 应返回错误", name)
+		}
+	}
+}
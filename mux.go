@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"reflect"
+)
+
+// 消息处理函数, Reply为nil时不回复
+type HandlerFunc func(ctx context.Context, header *MessageHeader, msg Message) (Reply, error)
+
+// 中间件, 包装处理函数以在其前后执行逻辑
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// 消息路由, 按菜单KEY、事件类型、消息类型的顺序匹配处理函数, 均未匹配时调用fallback
+type Mux struct {
+	menus       map[string]HandlerFunc
+	events      map[string]HandlerFunc
+	messages    map[reflect.Type]HandlerFunc
+	fallback    HandlerFunc
+	middlewares []Middleware
+}
+
+func NewMux() *Mux {
+	return &Mux{
+		menus:    map[string]HandlerFunc{},
+		events:   map[string]HandlerFunc{},
+		messages: map[reflect.Type]HandlerFunc{},
+	}
+}
+
+// 处理文本消息
+func (m *Mux) OnText(h HandlerFunc) {
+	m.OnMessage(TextMessage{}, h)
+}
+
+// 处理指定类型的事件, 如subscribe, SCAN, CLICK
+func (m *Mux) OnEvent(event string, h HandlerFunc) {
+	m.events[event] = h
+}
+
+// 处理点击指定KEY的自定义菜单事件, 优先于OnEvent("CLICK")
+func (m *Mux) OnMenuClick(key string, h HandlerFunc) {
+	m.menus[key] = h
+}
+
+// 处理与msg类型相同的消息, 如OnMessage(ImageMessage{}, h)
+func (m *Mux) OnMessage(msg Message, h HandlerFunc) {
+	m.messages[reflect.TypeOf(msg)] = h
+}
+
+// 处理未匹配的消息
+func (m *Mux) Fallback(h HandlerFunc) {
+	m.fallback = h
+}
+
+// 添加中间件, 先添加的中间件在外层
+func (m *Mux) Use(middlewares ...Middleware) {
+	m.middlewares = append(m.middlewares, middlewares...)
+}
+
+// 经过中间件后分发消息
+func (m *Mux) Handle(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
+	h := m.dispatch
+	for i := len(m.middlewares) - 1; i >= 0; i-- {
+		h = m.middlewares[i](h)
+	}
+	return h(ctx, header, msg)
+}
+
+func (m *Mux) dispatch(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
+	if click, ok := msg.(MenuClickEvent); ok {
+		if h, ok := m.menus[click.EventKey]; ok {
+			return h(ctx, header, msg)
+		}
+	}
+	if event := eventName(msg); event != "" {
+		if h, ok := m.events[event]; ok {
+			return h(ctx, header, msg)
+		}
+	}
+	if h, ok := m.messages[reflect.TypeOf(msg)]; ok {
+		return h(ctx, header, msg)
+	}
+	if m.fallback != nil {
+		return m.fallback(ctx, header, msg)
+	}
+	return nil, nil
+}
+
+// 取出事件消息的Event字段, 普通消息返回空字符串
+func eventName(msg Message) string {
+	v := reflect.ValueOf(msg)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	if f := v.FieldByName("Event"); f.IsValid() && f.Kind() == reflect.String {
+		return f.String()
+	}
+	return ""
+}
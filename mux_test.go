@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// 回复路由名称的处理函数
+func routeHandler(name string) HandlerFunc {
+	return func(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
+		return TextReply{Content: name}, nil
+	}
+}
+
+func TestMuxDispatch(t *testing.T) {
+	m := NewMux()
+	m.OnText(routeHandler("text"))
+	m.OnMessage(ImageMessage{}, routeHandler("image"))
+	m.OnMenuClick("Start", routeHandler("menu"))
+	m.OnEvent("CLICK", routeHandler("click"))
+	m.OnEvent("user_get_card", routeHandler("unknown"))
+	m.Fallback(routeHandler("fallback"))
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"文本消息", `<xml><FromUserName>oUser</FromUserName><CreateTime>1700000000</CreateTime><MsgType>text</MsgType><Content>开始</Content><MsgId>1</MsgId></xml>`, "text"},
+		{"图片消息", `<xml><FromUserName>oUser</FromUserName><CreateTime>1700000000</CreateTime><MsgType>image</MsgType><PicUrl>http://example.com/1.jpg</PicUrl><MediaId>m</MediaId><MsgId>2</MsgId></xml>`, "image"},
+		{"菜单KEY优先于CLICK事件", string(eventXML("CLICK", `<EventKey>Start</EventKey>`)), "menu"},
+		{"其他菜单KEY", string(eventXML("CLICK", `<EventKey>Other</EventKey>`)), "click"},
+		{"未支持的事件", string(eventXML("user_get_card", `<CardId>c</CardId>`)), "unknown"},
+		{"未注册的事件", string(eventXML("SCAN", `<EventKey>123</EventKey>`)), "fallback"},
+		{"未注册的消息", `<xml><FromUserName>oUser</FromUserName><CreateTime>1700000000</CreateTime><MsgType>voice</MsgType><MediaId>m</MediaId><MsgId>3</MsgId></xml>`, "fallback"},
+	}
+	for _, tt := range tests {
+		body := []byte(tt.body)
+		header, msg, err := Unmarshal(&body)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		reply, err := m.Handle(context.Background(), header, msg)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := reply.(TextReply).Content; got != tt.want {
+			t.Errorf("%s: 路由到%s, 应为%s", tt.name, got, tt.want)
+		}
+	}
+
+	// 未设置fallback时不回复
+	reply, err := NewMux().Handle(context.Background(), &MessageHeader{}, TextMessage{})
+	if reply != nil || err != nil {
+		t.Fatalf("返回%v, %v, 应不回复", reply, err)
+	}
+}
+
+func TestMuxUse(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
+				order = append(order, name+" before")
+				reply, err := next(ctx, header, msg)
+				order = append(order, name+" after")
+				return reply, err
+			}
+		}
+	}
+	m := NewMux()
+	m.Use(trace("a"), trace("b"))
+	m.Use(trace("c"))
+	m.Fallback(func(ctx context.Context, header *MessageHeader, msg Message) (Reply, error) {
+		order = append(order, "handler")
+		return nil, nil
+	})
+	m.Handle(context.Background(), &MessageHeader{}, TextMessage{})
+	// 先添加的中间件在外层
+	want := []string{"a before", "b before", "c before", "handler", "c after", "b after", "a after"}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("执行顺序为%v, 应为%v", order, want)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// 在终端中直接与小冰玩读心术, 用于排查小冰接口变更
+//
+//	bing play                  y/n/?分别回答是/不是/不知道, 其他输入原样发送
+//	bing play -v -o game.log   打印并记录小冰的原始响应
+const playUsage = `用法: bing play [选项]`
+
+type player struct {
+	bing       Bing
+	verbose    bool
+	timeout    time.Duration
+	transcript io.Writer // 对局记录, 包含每轮的原始响应
+}
+
+func runPlay(args []string) error {
+	fs := flag.NewFlagSet("play", flag.ExitOnError)
+	endpoint := fs.String("url", "", "小冰接口地址, 默认为"+baseURL)
+	timeout := fs.Duration("timeout", replyTimeout, "每轮交互的超时时间")
+	output := fs.String("o", "", "对局记录文件, 为空时不记录")
+	verbose := fs.Bool("v", false, "打印小冰的原始响应和接口日志")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), playUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	opts := bingOptions
+	if *endpoint != "" {
+		opts.HTTP.BaseURL = *endpoint
+	}
+	// 非verbose模式下不打印接口日志, 错误由REPL直接输出
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	p := &player{verbose: *verbose, timeout: *timeout, transcript: ioutil.Discard}
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("打开对局记录文件失败: %s", err)
+		}
+		defer f.Close()
+		p.transcript = f
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	bing, err := NewBing(ctx, opts)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("新建会话失败: %s", err)
+	}
+	p.bing = bing
+	fmt.Fprintf(p.transcript, "# %s 会话%s\n", time.Now().Format(time.RFC3339), bing.senderID)
+	return p.repl(os.Stdin, os.Stdout)
+}
+
+func (p *player) repl(in io.Reader, out io.Writer) error {
+	fmt.Fprintln(out, "y/n/?回答是/不是/不知道, /start重新开始, /history查看本局问答, /quit退出, 其他输入原样发送")
+	p.send(out, "开始", func(ctx context.Context) (GameTurn, error) {
+		return p.bing.Send(ctx, "开始")
+	})
+	scanner := bufio.NewScanner(in)
+	for fmt.Fprint(out, "> "); scanner.Scan(); fmt.Fprint(out, "> ") {
+		line := strings.TrimSpace(scanner.Text())
+		switch line {
+		case "":
+		case "/quit":
+			return nil
+		case "/history":
+			for _, round := range p.bing.history {
+				fmt.Fprintf(out, "%s -> %s\n", round.Send, round.Reply)
+			}
+		case "/start":
+			p.send(out, "开始", func(ctx context.Context) (GameTurn, error) {
+				return p.bing.Send(ctx, "开始")
+			})
+		case "y", "n", "?":
+			answer := map[string]int{"y": Yes, "n": No, "?": Pass}[line]
+			p.send(out, line, func(ctx context.Context) (GameTurn, error) {
+				return p.bing.Next(ctx, answer)
+			})
+		default:
+			p.send(out, line, func(ctx context.Context) (GameTurn, error) {
+				return p.bing.Send(ctx, line)
+			})
+		}
+	}
+	return scanner.Err()
+}
+
+// 进行一轮交互, 打印回复并写入对局记录
+func (p *player) send(out io.Writer, input string, fn func(ctx context.Context) (GameTurn, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	start := time.Now()
+	turn, err := fn(ctx)
+	elapsed := time.Since(start)
+
+	fmt.Fprintf(p.transcript, "> %s\n", input)
+	raw := bytes.TrimSpace(turn.Raw)
+	if schemaErr, ok := err.(SchemaError); ok {
+		// 响应格式错误时回复用户"小冰不知怎么回答", 原始响应是排查的关键
+		raw = bytes.TrimSpace(schemaErr.Raw)
+	}
+	if len(raw) > 0 {
+		fmt.Fprintf(p.transcript, "raw: %s\n", raw)
+		if p.verbose {
+			fmt.Fprintf(out, "[原始响应 %s] %s\n", elapsed.Round(time.Millisecond), raw)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(p.transcript, "error: %s\n", err)
+		fmt.Fprintln(out, "错误:", err)
+		return
+	}
+	fmt.Fprintf(p.transcript, "< %s\n", turn.Text)
+	fmt.Fprintln(out, turn.Text)
+	if p.verbose {
+		fmt.Fprintf(out, "[第%d题 猜测:%q 结束:%t 建议回复:%v]\n", turn.Index, turn.Guess, turn.End, turn.Suggestions)
+	}
+	if turn.End {
+		fmt.Fprintln(out, "本局结束, /start重新开始")
+	}
+}
@@ -27,10 +27,11 @@ type ReplyHeader struct {
 
 // 加密回复
 type EncryptReply struct {
-	Encrypt      string `xml:"Encrypt"`
-	MsgSignature string `xml:"MsgSignature"`
-	TimeStamp    string `xml:"TimeStamp"`
-	Nonce        string `xml:"Nonce"`
+	XMLName      xml.Name `xml:"xml"`
+	Encrypt      string   `xml:"Encrypt"`
+	MsgSignature string   `xml:"MsgSignature"`
+	TimeStamp    string   `xml:"TimeStamp"`
+	Nonce        string   `xml:"Nonce"`
 }
 
 // 所有回复
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"container/list"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 用户游戏会话存储
+type SessionStore interface {
+	Get(uid string) (Bing, error)    // 取出会话, 当error!=nil时, 会话不存在或已过期
+	Put(uid string, bing Bing) error // 保存会话, 并刷新其活跃时间
+	Delete(uid string) error         // 删除会话
+	Touch(uid string) error          // 刷新会话活跃时间, 会话不存在时返回error
+}
+
+// 按uid加锁, 同一用户的消息依次处理, 避免并发的两轮交互读到同一会话而互相覆盖
+// 只在进程内有效, 多副本共享FileSessionStore时需由负载均衡按用户分发
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	refs int // 持有或等待该锁的请求数, 为0时删除
+}
+
+func newUserLocks() *userLocks {
+	return &userLocks{locks: map[string]*userLock{}}
+}
+
+// 锁定uid, 返回解锁函数
+func (l *userLocks) Lock(uid string) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[uid]
+	if !ok {
+		lock = &userLock{}
+		l.locks[uid] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, uid)
+		}
+		l.mu.Unlock()
+	}
+}
+
+var _ SessionStore = (*MemorySessionStore)(nil)
+
+// 内存会话存储, 空闲超过ttl的会话被淘汰, 会话数超过maxSize时淘汰最久未活跃的会话
+type MemorySessionStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	items   map[string]*list.Element
+	lru     *list.List // 队首为最近活跃的会话
+}
+
+type memorySession struct {
+	uid    string
+	bing   Bing
+	expire time.Time
+}
+
+// ttl<=0时不按空闲时间淘汰, maxSize<=0时不限制会话数
+func NewMemorySessionStore(ttl time.Duration, maxSize int) *MemorySessionStore {
+	return &MemorySessionStore{
+		ttl:     ttl,
+		maxSize: maxSize,
+		items:   map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+func (s *MemorySessionStore) Get(uid string) (Bing, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[uid]
+	if !ok {
+		return Bing{}, fmt.Errorf("会话不存在: %s", uid)
+	}
+	item := e.Value.(*memorySession)
+	if s.expired(item, time.Now()) {
+		s.remove(e)
+		return Bing{}, fmt.Errorf("会话已过期: %s", uid)
+	}
+	return item.bing, nil
+}
+
+func (s *MemorySessionStore) Put(uid string, bing Bing) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if e, ok := s.items[uid]; ok {
+		item := e.Value.(*memorySession)
+		item.bing = bing
+		item.expire = now.Add(s.ttl)
+		s.lru.MoveToFront(e)
+	} else {
+		item := &memorySession{uid: uid, bing: bing, expire: now.Add(s.ttl)}
+		s.items[uid] = s.lru.PushFront(item)
+	}
+	s.evict(now)
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[uid]; ok {
+		s.remove(e)
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) Touch(uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[uid]
+	if !ok {
+		return fmt.Errorf("会话不存在: %s", uid)
+	}
+	now := time.Now()
+	item := e.Value.(*memorySession)
+	if s.expired(item, now) {
+		s.remove(e)
+		return fmt.Errorf("会话已过期: %s", uid)
+	}
+	item.expire = now.Add(s.ttl)
+	s.lru.MoveToFront(e)
+	return nil
+}
+
+// 当前会话数
+func (s *MemorySessionStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+func (s *MemorySessionStore) expired(item *memorySession, now time.Time) bool {
+	return s.ttl > 0 && item.expire.Before(now)
+}
+
+func (s *MemorySessionStore) remove(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.items, e.Value.(*memorySession).uid)
+}
+
+// 从队尾淘汰过期会话和超出容量的会话, 需持有锁
+func (s *MemorySessionStore) evict(now time.Time) {
+	for e := s.lru.Back(); e != nil; e = s.lru.Back() {
+		item := e.Value.(*memorySession)
+		if !s.expired(item, now) && (s.maxSize <= 0 || s.lru.Len() <= s.maxSize) {
+			break
+		}
+		s.remove(e)
+	}
+}
+
+var _ SessionStore = (*FileSessionStore)(nil)
+
+// 文件会话存储, 每个会话保存为目录下的一个JSON文件, 文件修改时间即活跃时间
+// 多个进程共享同一目录时可互相恢复会话, 适用于滚动部署和多副本
+type FileSessionStore struct {
+	dir  string
+	ttl  time.Duration
+	opts BingOptions
+}
+
+// ttl<=0时不按空闲时间淘汰, opts用于恢复会话
+func NewFileSessionStore(dir string, ttl time.Duration, opts BingOptions) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("创建会话目录失败: %s", err)
+	}
+	return &FileSessionStore{dir: dir, ttl: ttl, opts: opts}, nil
+}
+
+func (s *FileSessionStore) path(uid string) string {
+	return filepath.Join(s.dir, base64.RawURLEncoding.EncodeToString([]byte(uid))+".json")
+}
+
+func (s *FileSessionStore) Get(uid string) (Bing, error) {
+	path := s.path(uid)
+	info, err := os.Stat(path)
+	if err != nil {
+		return Bing{}, fmt.Errorf("会话不存在: %s", uid)
+	}
+	if s.ttl > 0 && time.Since(info.ModTime()) > s.ttl {
+		os.Remove(path)
+		return Bing{}, fmt.Errorf("会话已过期: %s", uid)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Bing{}, fmt.Errorf("读取会话失败: %s", err)
+	}
+	state := BingState{}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return Bing{}, fmt.Errorf("解析会话失败: %s", err)
+	}
+	return RestoreBing(state, s.opts)
+}
+
+func (s *FileSessionStore) Put(uid string, bing Bing) error {
+	b, err := json.Marshal(bing.State())
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再改名, 避免其他进程读到写了一半的会话
+	tmp, err := ioutil.TempFile(s.dir, ".session-*")
+	if err != nil {
+		return fmt.Errorf("保存会话失败: %s", err)
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("保存会话失败: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("保存会话失败: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(uid)); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("保存会话失败: %s", err)
+	}
+	return nil
+}
+
+func (s *FileSessionStore) Delete(uid string) error {
+	if err := os.Remove(s.path(uid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileSessionStore) Touch(uid string) error {
+	now := time.Now()
+	if err := os.Chtimes(s.path(uid), now, now); err != nil {
+		return fmt.Errorf("会话不存在: %s", uid)
+	}
+	return nil
+}
+
+// 删除所有空闲超过ttl的会话文件, 可定期调用
+func (s *FileSessionStore) Sweep() error {
+	if s.ttl <= 0 {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.IsDir() && filepath.Ext(info.Name()) == ".json" && time.Since(info.ModTime()) > s.ttl {
+			os.Remove(filepath.Join(s.dir, info.Name()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 用senderID区分会话
+func testSession(id string) Bing {
+	return Bing{senderID: id}
+}
+
+func TestMemorySessionStoreTTL(t *testing.T) {
+	s := NewMemorySessionStore(50*time.Millisecond, 0)
+	s.Put("a", testSession("a"))
+	s.Put("b", testSession("b"))
+	if bing, err := s.Get("a"); err != nil || bing.senderID != "a" {
+		t.Fatalf("取出会话%+v, %v", bing, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	// Touch刷新活跃时间, a在原过期时间后仍可取出
+	if err := s.Touch("a"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := s.Get("a"); err != nil {
+		t.Fatalf("Touch后会话过期: %s", err)
+	}
+	if _, err := s.Get("b"); err == nil {
+		t.Fatal("Get应返回会话已过期")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := s.Touch("a"); err == nil {
+		t.Fatal("Touch应返回会话已过期")
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("剩余%d个会话, 过期会话应被删除", n)
+	}
+	if err := s.Touch("c"); err == nil {
+		t.Fatal("Touch不存在的会话应返回error")
+	}
+}
+
+func TestMemorySessionStoreEvict(t *testing.T) {
+	s := NewMemorySessionStore(0, 3)
+	for _, uid := range []string{"a", "b", "c"} {
+		s.Put(uid, testSession(uid))
+	}
+	// 超出容量时淘汰最久未活跃的a
+	s.Put("d", testSession("d"))
+	if _, err := s.Get("a"); err == nil {
+		t.Fatal("a应被淘汰")
+	}
+	// Touch将b移到队首, 接着淘汰c
+	if err := s.Touch("b"); err != nil {
+		t.Fatal(err)
+	}
+	s.Put("e", testSession("e"))
+	if _, err := s.Get("c"); err == nil {
+		t.Fatal("c应被淘汰")
+	}
+	// Put已有会话同样移到队首, 接着淘汰d
+	s.Put("b", testSession("b2"))
+	s.Put("f", testSession("f"))
+	if _, err := s.Get("d"); err == nil {
+		t.Fatal("d应被淘汰")
+	}
+	for _, uid := range []string{"b", "e", "f"} {
+		if _, err := s.Get(uid); err != nil {
+			t.Fatalf("%s: %s", uid, err)
+		}
+	}
+	if bing, _ := s.Get("b"); bing.senderID != "b2" {
+		t.Fatalf("会话b为%s, 应为更新后的b2", bing.senderID)
+	}
+	if n := s.Len(); n != 3 {
+		t.Fatalf("剩余%d个会话, 应为3个", n)
+	}
+}
+
+func TestMemorySessionStoreConcurrent(t *testing.T) {
+	s := NewMemorySessionStore(time.Minute, 50)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				uid := fmt.Sprintf("u%d", (i*200+j)%100)
+				s.Put(uid, testSession(uid))
+				if bing, err := s.Get(uid); err == nil && bing.senderID != uid {
+					t.Errorf("取出%s的会话为%s", uid, bing.senderID)
+				}
+				s.Touch(uid)
+				if j%10 == 0 {
+					s.Delete(uid)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := s.Len(); n > 50 {
+		t.Fatalf("会话数%d超过容量50", n)
+	}
+}
+
+func TestUserLocks(t *testing.T) {
+	locks := newUserLocks()
+	var wg sync.WaitGroup
+	var running, total int
+	var mu sync.Mutex
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer locks.Lock("u")()
+			mu.Lock()
+			running++
+			if running > 1 {
+				t.Error("同一用户的锁被同时持有")
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			total++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if total != 20 {
+		t.Fatalf("完成%d次, 应为20次", total)
+	}
+	// 解锁后不再保留该用户的锁
+	if n := len(locks.locks); n != 0 {
+		t.Fatalf("剩余%d个锁, 应为0个", n)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 模拟微信服务器向/wechat推送消息, 用于本地调试
+//
+//	bing simulate text 开始
+//	bing simulate click Yes
+//	bing simulate subscribe
+//	bing simulate scan 123
+//	bing simulate location 39.9 116.4
+//	bing simulate -i                     交互模式, y/n/?分别点击是/否/不知道菜单
+const simulateUsage = `用法: bing simulate [选项] <text 内容|click KEY|subscribe|scan 场景值|location 纬度 经度>
+       bing simulate [选项] -i`
+
+// 模拟的微信推送消息
+type simMessage struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   string   `xml:"ToUserName"`
+	FromUserName string   `xml:"FromUserName"`
+	CreateTime   int64    `xml:"CreateTime"`
+	MsgType      string   `xml:"MsgType"`
+	Content      string   `xml:"Content,omitempty"`
+	MsgID        int64    `xml:"MsgId,omitempty"`
+	Event        string   `xml:"Event,omitempty"`
+	EventKey     string   `xml:"EventKey,omitempty"`
+	Ticket       string   `xml:"Ticket,omitempty"`
+	Latitude     float64  `xml:"Latitude,omitempty"`
+	Longitude    float64  `xml:"Longitude,omitempty"`
+	Precision    float64  `xml:"Precision,omitempty"`
+}
+
+// 安全模式下的推送消息
+type simEncryptMessage struct {
+	XMLName    xml.Name `xml:"xml"`
+	ToUserName string   `xml:"ToUserName"`
+	Encrypt    string   `xml:"Encrypt"`
+}
+
+// 回复中用于展示的字段
+type simReply struct {
+	MsgType  string `xml:"MsgType"`
+	Content  string `xml:"Content"`
+	MediaID  string `xml:"Image>MediaId"`
+	Articles []struct {
+		Title string `xml:"Title"`
+		URL   string `xml:"Url"`
+	} `xml:"Articles>item"`
+}
+
+type simulator struct {
+	endpoint string
+	mode     string // raw, compat, safe
+	openID   string
+	toUser   string
+	verbose  bool
+	cfg      Config
+	crypt    *MsgCrypt
+	client   *http.Client
+	seq      int64 // 文本消息的MsgId
+	lastTime int64 // 上一条消息的CreateTime
+}
+
+func runSimulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	endpoint := fs.String("url", "http://127.0.0.1:4321/wechat", "/wechat接口地址")
+	token := fs.String("token", config.Token, "公众号Token")
+	appID := fs.String("appid", config.AppID, "公众号AppID")
+	aesKey := fs.String("aeskey", config.EncodingAESKey, "EncodingAESKey, 不为空时默认使用安全模式")
+	mode := fs.String("mode", "", "消息加密方式: raw(明文), compat(兼容), safe(安全)")
+	openID := fs.String("openid", "o_simulator_"+randString(8), "模拟用户的OpenID")
+	toUser := fs.String("to", "gh_simulator", "公众号原始ID")
+	interactive := fs.Bool("i", false, "交互模式")
+	verbose := fs.Bool("v", false, "打印完整的请求和回复XML")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), simulateUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	s := &simulator{
+		endpoint: *endpoint,
+		mode:     *mode,
+		openID:   *openID,
+		toUser:   *toUser,
+		verbose:  *verbose,
+		cfg:      Config{AppID: *appID, Token: *token, EncodingAESKey: *aesKey},
+		client:   &http.Client{Timeout: 10 * time.Second},
+		seq:      time.Now().UnixNano(),
+	}
+	if s.mode == "" {
+		s.mode = "raw"
+		if *aesKey != "" {
+			s.mode = "safe"
+		}
+	}
+	switch s.mode {
+	case "raw":
+	case "compat", "safe":
+		crypt, err := NewMsgCrypt(s.cfg)
+		if err != nil {
+			return err
+		}
+		s.crypt = &crypt
+	default:
+		return fmt.Errorf("未知的加密方式: %s", s.mode)
+	}
+
+	if *interactive {
+		return s.interact(os.Stdin, os.Stdout)
+	}
+	msg, err := s.parseCommand(fs.Args())
+	if err != nil {
+		fs.Usage()
+		return err
+	}
+	return s.send(msg, os.Stdout)
+}
+
+// 解析命令为推送消息
+func (s *simulator) parseCommand(args []string) (simMessage, error) {
+	if len(args) == 0 {
+		return simMessage{}, fmt.Errorf("缺少消息类型")
+	}
+	// 事件以FromUserName+CreateTime排重, 同一秒内的多个事件顺延CreateTime, 避免被当作重试
+	s.seq++
+	s.lastTime++
+	if now := time.Now().Unix(); now > s.lastTime {
+		s.lastTime = now
+	}
+	msg := simMessage{
+		ToUserName:   s.toUser,
+		FromUserName: s.openID,
+		CreateTime:   s.lastTime,
+		MsgType:      "event",
+	}
+	switch args[0] {
+	case "text":
+		if len(args) < 2 {
+			return msg, fmt.Errorf("缺少文本内容")
+		}
+		msg.MsgType = "text"
+		msg.Content = strings.Join(args[1:], " ")
+		msg.MsgID = s.seq
+	case "click":
+		if len(args) != 2 {
+			return msg, fmt.Errorf("缺少菜单KEY")
+		}
+		msg.Event = "CLICK"
+		msg.EventKey = args[1]
+	case "subscribe":
+		msg.Event = "subscribe"
+	case "unsubscribe":
+		msg.Event = "unsubscribe"
+	case "scan":
+		if len(args) != 2 {
+			return msg, fmt.Errorf("缺少二维码场景值")
+		}
+		msg.Event = "SCAN"
+		msg.EventKey = args[1]
+		msg.Ticket = "simulator_ticket"
+	case "location":
+		if len(args) != 3 {
+			return msg, fmt.Errorf("缺少纬度和经度")
+		}
+		lat, err1 := strconv.ParseFloat(args[1], 64)
+		lng, err2 := strconv.ParseFloat(args[2], 64)
+		if err1 != nil || err2 != nil {
+			return msg, fmt.Errorf("纬度或经度格式错误")
+		}
+		msg.Event = "LOCATION"
+		msg.Latitude = lat
+		msg.Longitude = lng
+		msg.Precision = 30
+	default:
+		return msg, fmt.Errorf("未知的消息类型: %s", args[0])
+	}
+	return msg, nil
+}
+
+// 交互模式, 以"/"开头的行为命令, y/n/?为菜单回答, 其他行作为文本消息
+func (s *simulator) interact(in io.Reader, out io.Writer) error {
+	fmt.Fprintf(out, "模拟用户%s, 输入文本发送消息, y/n/?回答是/否/不知道, /click KEY, /subscribe, /scan 场景值, /location 纬度 经度, /quit退出\n", s.openID)
+	scanner := bufio.NewScanner(in)
+	for fmt.Fprint(out, "> "); scanner.Scan(); fmt.Fprint(out, "> ") {
+		line := strings.TrimSpace(scanner.Text())
+		var args []string
+		switch {
+		case line == "":
+			continue
+		case line == "/quit":
+			return nil
+		case line == "y":
+			args = []string{"click", "Yes"}
+		case line == "n":
+			args = []string{"click", "No"}
+		case line == "?":
+			args = []string{"click", "Pass"}
+		case strings.HasPrefix(line, "/"):
+			args = strings.Fields(line[1:])
+		default:
+			args = []string{"text", line}
+		}
+		msg, err := s.parseCommand(args)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			continue
+		}
+		if err := s.send(msg, out); err != nil {
+			fmt.Fprintln(out, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// 签名并按加密方式推送消息, 打印回复
+func (s *simulator) send(msg simMessage, out io.Writer) error {
+	plain, err := xml.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if s.verbose {
+		fmt.Fprintf(out, "--> %s\n", plain)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := randString(10)
+	body := plain
+	query := url.Values{}
+	query.Set("openid", s.openID)
+	if s.crypt != nil {
+		// Encrypt生成的timestamp, nonce和msg_signature即微信推送时URL中的参数
+		b, err := s.crypt.Encrypt(&plain)
+		if err != nil {
+			return err
+		}
+		encrypted := EncryptReply{}
+		if err := xml.Unmarshal(b, &encrypted); err != nil {
+			return err
+		}
+		timestamp, nonce = encrypted.TimeStamp, encrypted.Nonce
+		query.Set("encrypt_type", "aes")
+		query.Set("msg_signature", encrypted.MsgSignature)
+		if s.mode == "safe" {
+			body, err = xml.Marshal(simEncryptMessage{ToUserName: s.toUser, Encrypt: encrypted.Encrypt})
+			if err != nil {
+				return err
+			}
+		} else {
+			// 兼容模式同时包含明文字段和密文
+			body = bytes.Replace(plain, []byte("</xml>"), []byte("<Encrypt>"+encrypted.Encrypt+"</Encrypt></xml>"), 1)
+		}
+	}
+	query.Set("timestamp", timestamp)
+	query.Set("nonce", nonce)
+	query.Set("signature", MakeSignature(s.cfg, timestamp, nonce))
+
+	resp, err := s.client.Post(s.endpoint+"?"+query.Encode(), "text/xml", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("推送消息失败: %s", err)
+	}
+	defer resp.Body.Close()
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("读取回复失败: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("接口返回错误: %s %s", resp.Status, reply)
+	}
+	return s.printReply(reply, out)
+}
+
+// 解密并打印回复
+func (s *simulator) printReply(reply []byte, out io.Writer) error {
+	if len(reply) == 0 || string(reply) == "success" {
+		fmt.Fprintln(out, "(无被动回复, 回复可能将通过客服消息发送)")
+		return nil
+	}
+	if s.crypt != nil && bytes.Contains(reply, []byte("<Encrypt>")) {
+		encrypted := EncryptReply{}
+		if err := xml.Unmarshal(reply, &encrypted); err != nil {
+			return fmt.Errorf("解析加密回复失败: %s", err)
+		}
+		plain, err := s.crypt.Decrypt(&reply, encrypted.TimeStamp, encrypted.Nonce, encrypted.MsgSignature)
+		if err != nil {
+			return fmt.Errorf("解密回复失败: %s", err)
+		}
+		reply = plain
+	}
+	if s.verbose {
+		fmt.Fprintf(out, "<-- %s\n", reply)
+	}
+	r := simReply{}
+	if err := xml.Unmarshal(reply, &r); err != nil {
+		return fmt.Errorf("解析回复失败: %s, 回复: %s", err, reply)
+	}
+	switch r.MsgType {
+	case "text":
+		fmt.Fprintln(out, r.Content)
+	case "news":
+		for _, a := range r.Articles {
+			fmt.Fprintf(out, "[图文] %s %s\n", a.Title, a.URL)
+		}
+	default:
+		fmt.Fprintf(out, "[%s] %s\n", r.MsgType, reply)
+	}
+	return nil
+}
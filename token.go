@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 中心AccessToken服务: 由一个进程负责向微信拉取AccessToken和ticket,
+// 其他服务通过RemoteCache从该进程获取, 避免互相使对方的AccessToken失效
+
+// AccessToken服务的响应
+type tokenResponse struct {
+	Value     string `json:"value"`
+	ExpiresIn int    `json:"expires_in"` // 建议客户端缓存的秒数
+}
+
+// 返回AccessToken服务的http.Handler, 请求需携带"Authorization: Bearer <secret>"
+//
+//	GET    /token?name=access_token              获取AccessToken, name可为access_token, jsapi_ticket, wx_card_ticket
+//	DELETE /token?name=access_token&value=xxx    报告AccessToken已失效, 服务端重新拉取
+func (c Client) TokenServer(secret string) http.Handler {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if secret == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		switch r.Method {
+		case http.MethodGet:
+			var value string
+			var err error
+			switch name {
+			case CacheKeyAccessToken, "":
+				value, err = c.getToken()
+			case CacheKeyJSAPITicket:
+				value, err = c.GetJSAPITicket()
+			case CacheKeyCardTicket:
+				value, err = c.GetCardTicket()
+			default:
+				http.Error(w, "unknown name", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Println("AccessToken服务:", err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			// 微信在刷新后的5分钟内仍接受旧的AccessToken, 客户端缓存时间不超过提前刷新时间的一半
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(tokenResponse{
+				Value:     value,
+				ExpiresIn: int(c.config.TokenRefreshMargin / 2 / time.Second),
+			})
+		case http.MethodDelete:
+			if name != CacheKeyAccessToken && name != "" {
+				c.cache.Delete(c.cacheKey(name))
+			} else {
+				c.invalidateToken(r.URL.Query().Get("value"))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return serveMux
+}
+
+// 从AccessToken服务获取值的Cache, Client使用该Cache时不再直接向微信拉取AccessToken
+type RemoteCache struct {
+	endpoint string // AccessToken服务地址, 如http://10.0.0.1:4322
+	secret   string
+	client   *http.Client
+	local    *SimpleCache
+}
+
+func NewRemoteCache(endpoint string, secret string) *RemoteCache {
+	return &RemoteCache{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		secret:   secret,
+		client:   &http.Client{Timeout: 3 * time.Second},
+		local:    &SimpleCache{entries: map[string]cacheEntry{}},
+	}
+}
+
+// 实现tokenOwner, 告知Client不要自行拉取AccessToken
+func (r *RemoteCache) remoteToken() {}
+
+// key为Client传入的"AppID:name", 只取name部分发给服务端
+func remoteName(key string) string {
+	if i := strings.LastIndex(key, ":"); i >= 0 {
+		return key[i+1:]
+	}
+	return key
+}
+
+func (r *RemoteCache) Get(key string) (string, error) {
+	if value, err := r.local.Get(key); err == nil {
+		return value, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, r.endpoint+"/token?name="+url.QueryEscape(remoteName(key)), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.secret)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("请求AccessToken服务失败: %s", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("请求AccessToken服务失败: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("AccessToken服务返回错误(%d): %s", resp.StatusCode, b)
+	}
+	j := tokenResponse{}
+	if err := json.Unmarshal(b, &j); err != nil || j.Value == "" {
+		return "", fmt.Errorf("AccessToken服务响应格式错误: %s", b)
+	}
+	if j.ExpiresIn > 0 {
+		r.local.Set(key, j.Value, j.ExpiresIn)
+	}
+	return j.Value, nil
+}
+
+// 值由AccessToken服务维护, 忽略写入
+func (r *RemoteCache) Set(key string, value string, ttl int) error {
+	return nil
+}
+
+// 通知AccessToken服务该值已失效
+func (r *RemoteCache) Delete(key string) error {
+	value, _ := r.local.Get(key)
+	r.local.Delete(key)
+	values := url.Values{}
+	values.Set("name", remoteName(key))
+	values.Set("value", value)
+	req, err := http.NewRequest(http.MethodDelete, r.endpoint+"/token?"+values.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.secret)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("请求AccessToken服务失败: %s", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// 由外部服务负责拉取AccessToken的Cache
+type tokenOwner interface {
+	remoteToken()
+}
+
+var (
+	_ Cache      = (*RemoteCache)(nil)
+	_ tokenOwner = (*RemoteCache)(nil)
+)
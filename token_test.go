@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/speng4096/bing/wechattest"
+)
+
+// 在模拟微信接口的Client前启动AccessToken服务, 记录收到的请求
+func newTestTokenServer(t *testing.T, secret string) (*httptest.Server, *wechattest.Server, func() []*http.Request) {
+	t.Helper()
+	client, srv := newTestClient(t)
+	handler := client.TokenServer(secret)
+	var mu sync.Mutex
+	var requests []*http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, srv, func() []*http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*http.Request(nil), requests...)
+	}
+}
+
+// 使用RemoteCache的Client, 未配置AppSecret, 无法自行拉取AccessToken
+func newRemoteClient(t *testing.T, endpoint string, srv *wechattest.Server) Client {
+	t.Helper()
+	client, err := NewClient(Config{
+		AppID: "wx_test",
+		Cache: NewRemoteCache(endpoint, "s3cret"),
+		HTTP:  HTTPOptions{BaseURL: srv.BaseURL()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestTokenServerAuth(t *testing.T) {
+	ts, _, _ := newTestTokenServer(t, "s3cret")
+	empty, _, _ := newTestTokenServer(t, "")
+	tests := []struct {
+		name string
+		url  string
+		auth string
+		code int
+	}{
+		{"缺少Authorization", ts.URL, "", http.StatusUnauthorized},
+		{"secret错误", ts.URL, "Bearer wrong", http.StatusUnauthorized},
+		{"缺少Bearer前缀", ts.URL, "s3cret", http.StatusUnauthorized},
+		{"服务端secret为空", empty.URL, "Bearer ", http.StatusUnauthorized},
+		{"服务端secret为空且未携带", empty.URL, "", http.StatusUnauthorized},
+		{"secret正确", ts.URL, "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, tt.url+"/token?name=access_token", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: 返回%d, 应为%d", tt.name, resp.StatusCode, tt.code)
+		}
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	ts, srv, requests := newTestTokenServer(t, "s3cret")
+	client := newRemoteClient(t, ts.URL, srv)
+	for i := 0; i < 3; i++ {
+		if err := client.SetMenu(menu); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 只有AccessToken服务向微信拉取, RemoteCache缓存服务端返回的值
+	if n := len(srv.CallsTo("/token")); n != 1 {
+		t.Fatalf("调用/token %d次, 应为1次", n)
+	}
+	if n := len(requests()); n != 1 {
+		t.Fatalf("请求AccessToken服务%d次, 应为1次", n)
+	}
+
+	// AccessToken服务不可用时返回错误, 不自行拉取
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	if err := newRemoteClient(t, down.URL, srv).SetMenu(menu); err == nil {
+		t.Fatal("AccessToken服务不可用时应返回错误")
+	}
+	if n := len(srv.CallsTo("/token")); n != 1 {
+		t.Fatalf("调用/token %d次, 应为1次", n)
+	}
+}
+
+func TestRemoteCacheTokenInvalid(t *testing.T) {
+	ts, srv, requests := newTestTokenServer(t, "s3cret")
+	client := newRemoteClient(t, ts.URL, srv)
+	if err := client.SetMenu(menu); err != nil {
+		t.Fatal(err)
+	}
+	oldToken := srv.CallsTo("/menu/create")[0].Query.Get("access_token")
+
+	// 接口返回40001时通知服务端, 服务端重新拉取一次
+	srv.InjectError("/menu/create", wechattest.ErrCodeInvalidCredential)
+	if err := client.SetMenu(menu); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.TokensIssued(); n != 2 {
+		t.Fatalf("发放了%d个AccessToken, 应为2个", n)
+	}
+	var deletes []*http.Request
+	for _, r := range requests() {
+		if r.Method == http.MethodDelete {
+			deletes = append(deletes, r)
+		}
+	}
+	if len(deletes) != 1 || deletes[0].URL.Query().Get("value") != oldToken {
+		t.Fatalf("应报告一次失效的AccessToken %s: %v", oldToken, deletes)
+	}
+
+	// 其他实例稍后报告同一个旧值时, 服务端不再重新拉取
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/token?name=access_token&value="+oldToken, nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := newRemoteClient(t, ts.URL, srv).SetMenu(menu); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.TokensIssued(); n != 2 {
+		t.Fatalf("发放了%d个AccessToken, 旧值的失效报告不应触发拉取", n)
+	}
+}
@@ -1,9 +1,67 @@
 package main
 
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
 type Config struct {
 	AppID          string
 	AppSecret      string
 	Token          string
 	EncodingAESKey string
 	Cache          Cache
+	// 在AccessToken过期前提前刷新的时间, 默认5分钟
+	TokenRefreshMargin time.Duration
+	// 微信接口请求选项, BaseURL默认为https://api.weixin.qq.com/cgi-bin
+	HTTP HTTPOptions
+	// 微信接口请求超时, 默认10秒
+	Timeout time.Duration
+}
+
+// HTTP请求选项, 用于替换接口地址(如测试环境或代理), 或注入自定义的http.Client
+type HTTPOptions struct {
+	BaseURL    string            // 接口地址, 为空时使用默认地址
+	HTTPClient *http.Client      // 不为nil时以其为模板, 忽略Transport和Proxy, 其Timeout为0时使用调用方的超时
+	Transport  http.RoundTripper // 为nil时使用http.DefaultTransport
+	Proxy      string            // 出站HTTP代理, 如http://127.0.0.1:8080
+}
+
+// 返回BaseURL, 为空时返回defaultURL
+func (o HTTPOptions) baseURL(defaultURL string) string {
+	if o.BaseURL == "" {
+		return defaultURL
+	}
+	return o.BaseURL
+}
+
+// 构造http.Client, 每次返回新的实例, 可安全地设置各自的CookieJar
+func (o HTTPOptions) newHTTPClient(timeout time.Duration) (*http.Client, error) {
+	if o.HTTPClient != nil {
+		client := *o.HTTPClient
+		if client.Timeout == 0 {
+			client.Timeout = timeout
+		}
+		return &client, nil
+	}
+	transport := o.Transport
+	if o.Proxy != "" {
+		proxy, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("代理地址错误: %s", err)
+		}
+		base, ok := transport.(*http.Transport)
+		if transport == nil {
+			base, ok = http.DefaultTransport.(*http.Transport)
+		}
+		if !ok {
+			return nil, fmt.Errorf("自定义Transport不支持设置代理")
+		}
+		t := base.Clone()
+		t.Proxy = http.ProxyURL(proxy)
+		transport = t
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
 }
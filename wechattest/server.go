@@ -0,0 +1,341 @@
+// wechattest提供基于httptest的微信公众号接口模拟服务, 用于在无网络的环境中测试Client
+//
+//	srv := wechattest.NewServer("appid", "secret")
+//	defer srv.Close()
+//	client, err := NewClient(Config{AppID: "appid", AppSecret: "secret", HTTP: HTTPOptions{BaseURL: srv.BaseURL()}})
+//	srv.InjectError("/menu/create", wechattest.ErrCodeInvalidCredential)
+package wechattest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 常用的微信接口返回码
+const (
+	ErrCodeInvalidCredential  = 40001
+	ErrCodeInvalidAppID       = 40013
+	ErrCodeInvalidMediaID     = 40007
+	ErrCodeInvalidAppSecret   = 40125
+	ErrCodeMissingToken       = 41001
+	ErrCodeAccessTokenExpired = 42001
+	ErrCodeAPIRateLimit       = 45009
+	ErrCodeMenuNotExist       = 46003
+)
+
+// 接口地址前缀
+const prefix = "/cgi-bin"
+
+// 一次接口调用记录
+type Call struct {
+	Method string
+	Path   string // 不含/cgi-bin前缀, 如/menu/create
+	Query  url.Values
+	Body   []byte
+	Time   time.Time
+}
+
+// 模拟的微信公众号接口服务
+type Server struct {
+	*httptest.Server
+	AppID     string
+	AppSecret string
+	TokenTTL  time.Duration // 新AccessToken的有效期, 默认7200秒
+
+	mu          sync.Mutex
+	seq         int
+	tokens      map[string]time.Time // AccessToken -> 过期时间
+	menu        json.RawMessage
+	conditional map[string]json.RawMessage
+	messages    []json.RawMessage
+	media       map[string][]byte
+	faults      map[string][]int // 接口路径 -> 待返回的错误码
+	calls       []Call
+}
+
+// 启动模拟服务, 使用完毕后需调用Close
+func NewServer(appID string, appSecret string) *Server {
+	s := &Server{
+		AppID:       appID,
+		AppSecret:   appSecret,
+		TokenTTL:    7200 * time.Second,
+		tokens:      map[string]time.Time{},
+		conditional: map[string]json.RawMessage{},
+		media:       map[string][]byte{},
+		faults:      map[string][]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// 接口地址, 用作HTTPOptions.BaseURL
+func (s *Server) BaseURL() string {
+	return s.URL + prefix
+}
+
+// 使path的下一次调用返回错误码code, 多次调用时按顺序依次返回
+// path不含/cgi-bin前缀, 如/token, /menu/create
+func (s *Server) InjectError(path string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[path] = append(s.faults[path], code)
+}
+
+// 使所有已发放的AccessToken过期, 之后的调用返回42001
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token := range s.tokens {
+		s.tokens[token] = time.Time{}
+	}
+}
+
+// 全部调用记录
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// 对path的调用记录
+func (s *Server) CallsTo(path string) []Call {
+	var calls []Call
+	for _, call := range s.Calls() {
+		if call.Path == path {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// 已发放的AccessToken数
+func (s *Server) TokensIssued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tokens)
+}
+
+// 当前的自定义菜单, 未创建时为nil
+func (s *Server) Menu() json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.menu
+}
+
+// 已发送的客服消息
+func (s *Server) Messages() []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]json.RawMessage(nil), s.messages...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, Call{Method: r.Method, Path: path, Query: query, Body: body, Time: time.Now()})
+
+	if codes := s.faults[path]; len(codes) > 0 {
+		s.faults[path] = codes[1:]
+		writeError(w, codes[0])
+		return
+	}
+	if path == "/token" {
+		s.issueToken(w, query)
+		return
+	}
+	if code := s.checkToken(query.Get("access_token")); code != 0 {
+		writeError(w, code)
+		return
+	}
+	switch path {
+	case "/menu/create":
+		if !json.Valid(body) {
+			writeError(w, 40016)
+			return
+		}
+		s.menu = body
+		writeOK(w, nil)
+	case "/menu/get":
+		if s.menu == nil {
+			writeError(w, ErrCodeMenuNotExist)
+			return
+		}
+		var conditional []json.RawMessage
+		for _, menu := range s.conditional {
+			conditional = append(conditional, menu)
+		}
+		writeOK(w, map[string]interface{}{"menu": s.menu, "conditionalmenu": conditional})
+	case "/menu/delete":
+		s.menu = nil
+		s.conditional = map[string]json.RawMessage{}
+		writeOK(w, nil)
+	case "/menu/addconditional":
+		s.seq++
+		menuID := strconv.Itoa(s.seq)
+		menu := map[string]interface{}{}
+		if err := json.Unmarshal(body, &menu); err != nil {
+			writeError(w, 40016)
+			return
+		}
+		// /menu/get返回的menuid和matchrule中的sex、client_platform_type为数字
+		menu["menuid"] = s.seq
+		if rule, ok := menu["matchrule"].(map[string]interface{}); ok {
+			for _, k := range []string{"sex", "client_platform_type"} {
+				if v, ok := rule[k].(string); ok {
+					if n, err := strconv.Atoi(v); err == nil {
+						rule[k] = n
+					}
+				}
+			}
+		}
+		s.conditional[menuID], _ = json.Marshal(menu)
+		writeOK(w, map[string]interface{}{"menuid": menuID})
+	case "/menu/delconditional":
+		j := struct {
+			MenuID string `json:"menuid"`
+		}{}
+		json.Unmarshal(body, &j)
+		if _, ok := s.conditional[j.MenuID]; !ok {
+			writeError(w, ErrCodeMenuNotExist)
+			return
+		}
+		delete(s.conditional, j.MenuID)
+		writeOK(w, nil)
+	case "/get_current_selfmenu_info":
+		writeOK(w, map[string]interface{}{"is_menu_open": 1, "selfmenu_info": s.selfMenuInfo()})
+	case "/message/custom/send":
+		if !json.Valid(body) {
+			writeError(w, 40008)
+			return
+		}
+		s.messages = append(s.messages, body)
+		writeOK(w, nil)
+	case "/media/upload":
+		data, err := mediaFile(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			writeError(w, 41005)
+			return
+		}
+		s.seq++
+		mediaID := "MEDIA_" + strconv.Itoa(s.seq)
+		s.media[mediaID] = data
+		writeOK(w, map[string]interface{}{"type": query.Get("type"), "media_id": mediaID, "created_at": time.Now().Unix()})
+	case "/media/get":
+		b, ok := s.media[query.Get("media_id")]
+		if !ok {
+			writeError(w, ErrCodeInvalidMediaID)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b)
+	case "/ticket/getticket":
+		s.seq++
+		writeOK(w, map[string]interface{}{
+			"ticket":     fmt.Sprintf("TICKET_%s_%d", query.Get("type"), s.seq),
+			"expires_in": int(s.TokenTTL / time.Second),
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// 发放AccessToken, 需持有锁
+func (s *Server) issueToken(w http.ResponseWriter, query url.Values) {
+	if query.Get("appid") != s.AppID {
+		writeError(w, ErrCodeInvalidAppID)
+		return
+	}
+	if query.Get("secret") != s.AppSecret {
+		writeError(w, ErrCodeInvalidAppSecret)
+		return
+	}
+	s.seq++
+	token := fmt.Sprintf("TOKEN_%d", s.seq)
+	s.tokens[token] = time.Now().Add(s.TokenTTL)
+	writeJSON(w, map[string]interface{}{
+		"access_token": token,
+		"expires_in":   int(s.TokenTTL / time.Second),
+	})
+}
+
+// 检查AccessToken, 返回错误码, 需持有锁
+func (s *Server) checkToken(token string) int {
+	if token == "" {
+		return ErrCodeMissingToken
+	}
+	expire, ok := s.tokens[token]
+	if !ok {
+		return ErrCodeInvalidCredential
+	}
+	if expire.Before(time.Now()) {
+		return ErrCodeAccessTokenExpired
+	}
+	return 0
+}
+
+// 取出multipart请求中名为media的文件
+func mediaFile(contentType string, body []byte) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "media" {
+			return ioutil.ReadAll(part)
+		}
+	}
+}
+
+// 将/menu/create格式的菜单转换为selfmenu_info格式, 子菜单为{"list":[...]}, 需持有锁
+func (s *Server) selfMenuInfo() map[string]interface{} {
+	menu := struct {
+		Buttons []map[string]interface{} `json:"button"`
+	}{}
+	json.Unmarshal(s.menu, &menu)
+	buttons := []map[string]interface{}{}
+	for _, button := range menu.Buttons {
+		if sub, ok := button["sub_button"]; ok {
+			button["sub_button"] = map[string]interface{}{"list": sub}
+		}
+		buttons = append(buttons, button)
+	}
+	return map[string]interface{}{"button": buttons}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeOK(w http.ResponseWriter, fields map[string]interface{}) {
+	resp := map[string]interface{}{"errcode": 0, "errmsg": "ok"}
+	for k, v := range fields {
+		resp[k] = v
+	}
+	writeJSON(w, resp)
+}
+
+func writeError(w http.ResponseWriter, code int) {
+	writeJSON(w, map[string]interface{}{"errcode": code, "errmsg": fmt.Sprintf("fake error %d", code)})
+}